@@ -4,42 +4,153 @@ import (
 	"context"
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/andrescosta/goico/pkg/service/obs"
+	"github.com/rs/zerolog"
 )
 
-var ErrStopped = errors.New("broadcaster is stopped")
+var (
+	ErrStopped   = errors.New("broadcaster is stopped")
+	ErrQueueFull = errors.New("broadcaster queue is full")
+	ErrNoTopic   = errors.New("broadcaster has no topic function")
+	ErrFilter    = errors.New("filter is not a function of the message type")
+)
 
 type void struct{}
 
+// Policy is what a listener does with a message when its buffer is full.
+type Policy int
+
+const (
+	// PolicyBlock waits until the listener has room for the message. A slow
+	// listener delays the delivery to the others.
+	PolicyBlock Policy = iota
+	// PolicyDropNewest discards the message.
+	PolicyDropNewest
+	// PolicyDropOldest discards the oldest buffered message, so the buffer
+	// works as a ring that keeps the latest messages.
+	PolicyDropOldest
+	// PolicyDisconnect unsubscribes the listener and closes C.
+	PolicyDisconnect
+	// PolicyWait waits up to the wait of the listener, set with WithWait,
+	// for room for the message and then discards it. It is the default, so a
+	// stalled listener delays the others at most the wait of each message.
+	PolicyWait
+)
+
+const (
+	defaultBufferSize = 1
+	defaultWait       = time.Second
+)
+
+type Option func(*options)
+
+type options struct {
+	ordered   bool
+	queueSize int
+	topic     any
+	retainN   int
+	retainD   time.Duration
+	name      string
+	provider  *obs.OtelProvider
+}
+
+type SubscribeOption func(*subscription)
+
+type subscription struct {
+	bufferSize int
+	policy     Policy
+	wait       time.Duration
+	topics     []string
+	filter     any
+}
+
+// ListenerStats are the counters of a listener.
+type ListenerStats struct {
+	Delivered uint64
+	Dropped   uint64
+	// Disconnected reports that the listener was unsubscribed because it did
+	// not keep up, under PolicyDisconnect.
+	Disconnected bool
+}
+
 type Broadcaster[T any] struct {
-	listeners     *sync.Map
+	listeners     *index[T]
 	c             chan T
 	ctx           context.Context
 	cancel        context.CancelFunc
 	worker        *sync.WaitGroup
 	statusBarrier *statusBarrier
+	ordered       bool
+	replays       chan replayRequest[T]
+	// seq, retained and the retention window are owned by the worker.
+	seq       uint64
+	lastSeq   atomic.Uint64
+	retained  []retained[T]
+	retainN   int
+	retainD   time.Duration
+	telemetry *telemetry
 }
 
 type Listener[T any] struct {
 	C             <-chan T
 	c             chan T
+	policy        Policy
+	wait          time.Duration
+	topics        []string
+	filter        func(T) bool
+	done          chan void
+	closeDone     sync.Once
 	statusBarrier *statusBarrier
+	delivered     atomic.Uint64
+	dropped       atomic.Uint64
+	disconnected  atomic.Bool
+	detach        func() error
+	// fwd, peer and from are set in the listeners of SubscribeFrom, which
+	// forward the messages from the sequence from on to peer.
+	fwd  func(context.Context, uint64, T) (bool, error)
+	peer peer
+	from uint64
 }
 
-func New[T any](ctx context.Context) *Broadcaster[T] {
+func New[T any](ctx context.Context, opts ...Option) *Broadcaster[T] {
+	o := options{queueSize: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.queueSize < 1 {
+		o.queueSize = 1
+	}
+	topic, ok := o.topic.(func(T) string)
+	if o.topic != nil && !ok {
+		panic("broadcaster: the topic function is not a function of the message type")
+	}
 	ctx1, cancel := context.WithCancel(ctx)
-	return &Broadcaster[T]{
-		listeners:     &sync.Map{},
-		c:             make(chan T, 1),
+	b := &Broadcaster[T]{
+		listeners:     newIndex[T](topic),
+		c:             make(chan T, o.queueSize),
 		ctx:           ctx1,
 		cancel:        cancel,
 		worker:        &sync.WaitGroup{},
 		statusBarrier: newStatusBarrier(),
+		ordered:       o.ordered,
+		replays:       make(chan replayRequest[T]),
+		retainN:       o.retainN,
+		retainD:       o.retainD,
 	}
+	t, err := newTelemetry(b, o.provider, o.name)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("broadcaster", o.name).Msg("broadcaster: metrics disabled")
+		t, _ = newTelemetry(b, nil, o.name)
+	}
+	b.telemetry = t
+	return b
 }
 
-func NewAndStart[T any](ctx context.Context) *Broadcaster[T] {
-	broadcaster := New[T](ctx)
+func NewAndStart[T any](ctx context.Context, opts ...Option) *Broadcaster[T] {
+	broadcaster := New[T](ctx, opts...)
 	broadcaster.Start()
 	return broadcaster
 }
@@ -58,15 +169,14 @@ func (b *Broadcaster[T]) Start() {
 			case <-b.ctx.Done():
 				return
 			case d := <-b.c:
-				b.listeners.Range(func(k any, _ any) bool {
-					select {
-					case <-b.ctx.Done():
-						return false
-					default:
-						_ = k.(*Listener[T]).write(d)
-						return true
-					}
-				})
+				start := time.Now()
+				seq := b.retain(d)
+				dropped := b.deliver(seq, d)
+				b.lastSeq.Store(seq)
+				b.telemetry.recordFanout(b.ctx, start, dropped)
+			case r := <-b.replays:
+				l, err := b.replay(r)
+				r.done <- replayResult[T]{l: l, err: err}
 			}
 		}
 	}()
@@ -74,53 +184,132 @@ func (b *Broadcaster[T]) Start() {
 }
 
 func (b *Broadcaster[T]) Stop() error {
+	if b.IsStopped() {
+		return ErrStopped
+	}
+	// canceled before taking the lock, so the pending writes give up
+	b.cancel()
 	b.statusBarrier.EnteringStatusArea()
 	defer b.statusBarrier.OutOfStatusArea()
 	if b.statusBarrier.IsStopped() {
 		return ErrStopped
 	}
-	b.cancel()
 	b.worker.Wait()
-	b.listeners.Range(func(k any, _ any) bool {
-		_ = k.(*Listener[T]).stop()
-		b.listeners.Delete(k)
-		return true
-	})
+	for _, l := range b.listeners.removeAll() {
+		_ = l.stop()
+	}
 	close(b.c)
 	b.statusBarrier.MarkStopped()
-	return nil
+	return b.telemetry.close()
 }
 
-func (b *Broadcaster[T]) Subscribe() (*Listener[T], error) {
+// deliver writes t to the listeners subscribed to it. It returns how many
+// messages the listeners dropped.
+func (b *Broadcaster[T]) deliver(seq uint64, t T) uint64 {
+	var dropped uint64
+	for _, l := range b.listeners.match(t) {
+		select {
+		case <-b.ctx.Done():
+			return dropped
+		default:
+		}
+		if l.filter != nil && !l.filter(t) {
+			continue
+		}
+		var ok bool
+		before := l.droppedCount()
+		if l.fwd != nil {
+			if seq < l.from {
+				continue
+			}
+			ok, _ = l.fwd(b.ctx, seq, t)
+		} else {
+			ok, _ = l.write(b.ctx, t)
+		}
+		dropped += l.droppedCount() - before
+		if !ok {
+			b.disconnect(l)
+		}
+	}
+	return dropped
+}
+
+// Subscribe returns a listener of the messages written from now on. By
+// default the listener buffers one message and, when it is full, waits a
+// second for room before discarding the message.
+func (b *Broadcaster[T]) Subscribe(opts ...SubscribeOption) (*Listener[T], error) {
 	b.statusBarrier.Entering()
 	defer b.statusBarrier.Out()
 	if b.statusBarrier.IsStopped() {
 		return nil, ErrStopped
 	}
-	l := startListener[T]()
-	b.listeners.Store(l, void{})
+	s, err := b.subscription(opts)
+	if err != nil {
+		return nil, err
+	}
+	l := startListener[T](s)
+	l.detach = func() error {
+		return b.Unsubscribe(l)
+	}
+	b.listeners.add(l)
 	return l, nil
 }
 
-func startListener[T any]() *Listener[T] {
-	m := make(chan T, 1)
+func (b *Broadcaster[T]) subscription(opts []SubscribeOption) (subscription, error) {
+	s := subscription{
+		bufferSize: defaultBufferSize,
+		policy:     PolicyWait,
+		wait:       defaultWait,
+	}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	if len(s.topics) > 0 && b.listeners.topic == nil {
+		return s, ErrNoTopic
+	}
+	if _, ok := s.filter.(func(T) bool); s.filter != nil && !ok {
+		return s, ErrFilter
+	}
+	return s, nil
+}
+
+func startListener[T any](s subscription) *Listener[T] {
+	if s.bufferSize < 1 {
+		s.bufferSize = defaultBufferSize
+	}
+	m := make(chan T, s.bufferSize)
 	l := &Listener[T]{
 		C:             m,
 		c:             m,
+		policy:        s.policy,
+		wait:          s.wait,
+		topics:        s.topics,
+		done:          make(chan void),
 		statusBarrier: newStatusBarrier(),
 	}
+	l.filter, _ = s.filter.(func(T) bool)
 	l.statusBarrier.MarkStarted()
 	return l
 }
 
+// disconnect unsubscribes a listener that did not keep up.
+func (b *Broadcaster[T]) disconnect(l *Listener[T]) {
+	if b.listeners.remove(l) {
+		l.markDisconnected()
+		if l.peer != nil {
+			l.peer.markDisconnected()
+		}
+		_ = l.stop()
+	}
+}
+
 func (b *Broadcaster[T]) Unsubscribe(l *Listener[T]) error {
 	b.statusBarrier.Entering()
 	defer b.statusBarrier.Out()
 	if b.statusBarrier.IsStopped() {
 		return ErrStopped
 	}
-	_, ok := b.listeners.LoadAndDelete(l)
-	if ok {
+	if b.listeners.remove(l) {
 		_ = l.stop()
 	}
 	return nil
@@ -132,22 +321,67 @@ func (b *Broadcaster[T]) IsSubscribed(l *Listener[T]) (bool, error) {
 	if b.statusBarrier.IsStopped() {
 		return false, ErrStopped
 	}
-	_, ok := b.listeners.Load(l)
-	return ok, nil
+	return b.listeners.contains(l), nil
 }
 
+// Write broadcasts t. It is WriteCtx without a deadline.
 func (b *Broadcaster[T]) Write(t T) error {
+	return b.WriteCtx(context.Background(), t)
+}
+
+// WriteCtx is Write with a context, a separate method so Write keeps its
+// signature. In ordered mode t is queued behind the previous messages, or
+// ErrQueueFull is returned without waiting. Otherwise t is sent in the
+// background, so messages can be delivered out of order, and it is discarded
+// if it is not sent in ten seconds or before ctx ends.
+func (b *Broadcaster[T]) WriteCtx(ctx context.Context, t T) error {
+	return b.write(ctx, t, false)
+}
+
+// WriteWait is WriteCtx waiting in ordered mode for room in the queue until
+// ctx ends, so the writer slows down to the pace of the listeners instead of
+// getting ErrQueueFull.
+func (b *Broadcaster[T]) WriteWait(ctx context.Context, t T) error {
+	return b.write(ctx, t, true)
+}
+
+func (b *Broadcaster[T]) write(ctx context.Context, t T, wait bool) error {
 	b.statusBarrier.Entering()
 	if b.statusBarrier.IsStopped() {
 		b.statusBarrier.Out()
 		return ErrStopped
 	}
+	if b.ordered {
+		defer b.statusBarrier.Out()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !wait {
+			select {
+			case b.c <- t:
+				return nil
+			default:
+				return ErrQueueFull
+			}
+		}
+		select {
+		case b.c <- t:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-b.ctx.Done():
+			return ErrStopped
+		}
+	}
 	go func() {
 		defer b.statusBarrier.Out()
 		ti := time.NewTimer(10 * time.Second)
+		defer ti.Stop()
 		select {
 		case b.c <- t:
 		case <-ti.C:
+		case <-ctx.Done():
+		case <-b.ctx.Done():
 		}
 	}()
 	return nil
@@ -160,14 +394,18 @@ func (b *Broadcaster[T]) WriteSync(t T) error {
 		return ErrStopped
 	}
 	ti := time.NewTimer(10 * time.Second)
+	defer ti.Stop()
 	select {
 	case b.c <- t:
 	case <-ti.C:
+	case <-b.ctx.Done():
 	}
 	return nil
 }
 
 func (b *Listener[T]) stop() error {
+	// releases a write blocked on the listener before taking the lock
+	b.closeDone.Do(func() { close(b.done) })
 	b.statusBarrier.EnteringStatusArea()
 	defer b.statusBarrier.OutOfStatusArea()
 	if b.statusBarrier.IsStopped() {
@@ -175,6 +413,9 @@ func (b *Listener[T]) stop() error {
 	}
 	close(b.c)
 	b.statusBarrier.MarkStopped()
+	if b.peer != nil {
+		return b.peer.stop()
+	}
 	return nil
 }
 
@@ -184,16 +425,160 @@ func (b *Broadcaster[T]) IsStopped() bool {
 	return b.statusBarrier.IsStopped()
 }
 
-func (b *Listener[T]) write(t T) error {
+// Close unsubscribes the listener.
+func (b *Listener[T]) Close() error {
+	if b.detach == nil {
+		return nil
+	}
+	return b.detach()
+}
+
+func (b *Listener[T]) markDisconnected() {
+	b.disconnected.Store(true)
+}
+
+func (b *Listener[T]) lag() int {
+	return len(b.c)
+}
+
+// droppedCount returns the messages dropped by the listener, or by its peer.
+func (b *Listener[T]) droppedCount() uint64 {
+	if b.peer != nil {
+		return b.peer.Stats().Dropped
+	}
+	return b.dropped.Load()
+}
+
+// Stats returns the counters of the listener.
+func (b *Listener[T]) Stats() ListenerStats {
+	return ListenerStats{
+		Delivered:    b.delivered.Load(),
+		Dropped:      b.dropped.Load(),
+		Disconnected: b.disconnected.Load(),
+	}
+}
+
+// write delivers t following the policy of the listener. It returns false
+// when the listener must be disconnected.
+func (b *Listener[T]) write(ctx context.Context, t T) (bool, error) {
 	b.statusBarrier.Entering()
 	defer b.statusBarrier.Out()
 	if b.statusBarrier.IsStopped() {
-		return ErrStopped
+		return true, ErrStopped
 	}
-	ti := time.NewTimer(1 * time.Second)
 	select {
 	case b.c <- t:
-	case <-ti.C:
+		b.delivered.Add(1)
+		return true, nil
+	default:
+	}
+	switch b.policy {
+	case PolicyDropNewest:
+		b.dropped.Add(1)
+	case PolicyDropOldest:
+		// only the worker sends, so there is room after taking one unless the
+		// receiver took it first
+		select {
+		case <-b.c:
+			b.dropped.Add(1)
+		default:
+		}
+		select {
+		case b.c <- t:
+			b.delivered.Add(1)
+		default:
+			b.dropped.Add(1)
+		}
+	case PolicyDisconnect:
+		b.dropped.Add(1)
+		return false, nil
+	case PolicyWait:
+		ti := time.NewTimer(b.wait)
+		defer ti.Stop()
+		select {
+		case b.c <- t:
+			b.delivered.Add(1)
+		case <-ti.C:
+			b.dropped.Add(1)
+		case <-b.done:
+		case <-ctx.Done():
+		}
+	default:
+		select {
+		case b.c <- t:
+			b.delivered.Add(1)
+		case <-b.done:
+		case <-ctx.Done():
+		}
+	}
+	return true, nil
+}
+
+// Setters
+
+// WithOrdered delivers the messages in the order they are written, queueing
+// up to queueSize of them.
+func WithOrdered(queueSize int) Option {
+	return func(o *options) {
+		o.ordered = true
+		o.queueSize = queueSize
+	}
+}
+
+// WithName sets the name of the broadcaster in its metrics.
+func WithName(name string) Option {
+	return func(o *options) {
+		o.name = name
+	}
+}
+
+// WithOtelProvider exports the metrics of the broadcaster. Nil disables them.
+func WithOtelProvider(p *obs.OtelProvider) Option {
+	return func(o *options) {
+		o.provider = p
+	}
+}
+
+// WithTopic sets the function that returns the topic of a message, to
+// subscribe with WithTopics. topic must be a func(T) string.
+func WithTopic[T any](topic func(T) string) Option {
+	return func(o *options) {
+		o.topic = topic
+	}
+}
+
+func WithBufferSize(n int) SubscribeOption {
+	return func(s *subscription) {
+		s.bufferSize = n
+	}
+}
+
+func WithPolicy(p Policy) SubscribeOption {
+	return func(s *subscription) {
+		s.policy = p
+	}
+}
+
+// WithWait sets how long PolicyWait waits for room for a message. It is one
+// second by default.
+func WithWait(d time.Duration) SubscribeOption {
+	return func(s *subscription) {
+		s.wait = d
+	}
+}
+
+// WithTopics delivers only the messages of the topics. A topic ending in
+// Wildcard matches the topics with its prefix.
+func WithTopics(topics ...string) SubscribeOption {
+	return func(s *subscription) {
+		s.topics = topics
+	}
+}
+
+// WithFilter delivers only the messages for which filter returns true. It is
+// evaluated after the topics, by the delivery goroutine, so it must be fast.
+func WithFilter[T any](filter func(T) bool) SubscribeOption {
+	return func(s *subscription) {
+		s.filter = filter
 	}
-	return nil
 }
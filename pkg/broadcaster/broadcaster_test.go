@@ -4,7 +4,9 @@ import (
 	"context"
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"math/big"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -12,7 +14,12 @@ import (
 
 	//revive:disable-next-line:dot-imports
 	. "github.com/andrescosta/goico/pkg/broadcaster"
+	"github.com/andrescosta/goico/pkg/database"
+	"github.com/andrescosta/goico/pkg/service/obs"
 	"github.com/andrescosta/goico/pkg/test"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 )
 
 type data struct {
@@ -776,6 +783,647 @@ func TestWithTimeoutContext(t *testing.T) {
 	cancel()
 }
 
+func TestPolicies(t *testing.T) {
+	cases := []struct {
+		name     string
+		policy   Policy
+		received []int
+		stats    ListenerStats
+	}{
+		{"drop_newest", PolicyDropNewest, []int{0, 1}, ListenerStats{Delivered: 2, Dropped: 3}},
+		{"drop_oldest", PolicyDropOldest, []int{3, 4}, ListenerStats{Delivered: 5, Dropped: 3}},
+		{"disconnect", PolicyDisconnect, []int{0, 1}, ListenerStats{Delivered: 2, Dropped: 1, Disconnected: true}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := NewAndStart[data](context.Background())
+			defer func() {
+				err := b.Stop()
+				test.Nil(t, err)
+			}()
+			l, err := b.Subscribe(WithPolicy(c.policy), WithBufferSize(2))
+			test.Nil(t, err)
+			for i := 0; i < 5; i++ {
+				err := b.WriteSync(data{id: i})
+				test.Nil(t, err)
+			}
+			eventually(t, func() bool {
+				s := l.Stats()
+				return s.Delivered+s.Dropped >= 5 || s.Disconnected
+			})
+			test.Equals(t, l.Stats(), c.stats)
+			var received []int
+			for range c.received {
+				d := <-l.C
+				received = append(received, d.id)
+			}
+			test.Equals(t, received, c.received)
+			subscribed, err := b.IsSubscribed(l)
+			test.Nil(t, err)
+			test.Equals(t, subscribed, !c.stats.Disconnected)
+			if c.stats.Disconnected {
+				_, ok := <-l.C
+				test.Equals(t, ok, false)
+			}
+		})
+	}
+}
+
+func TestUnsubscribeBlocked(t *testing.T) {
+	b := NewAndStart[data](context.Background())
+	defer func() {
+		err := b.Stop()
+		test.Nil(t, err)
+	}()
+	slow, err := b.Subscribe(WithPolicy(PolicyBlock))
+	test.Nil(t, err)
+	fast, err := b.Subscribe(WithBufferSize(10))
+	test.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		err := b.WriteSync(data{id: i})
+		test.Nil(t, err)
+	}
+	// the delivery is blocked on slow until it is unsubscribed
+	eventually(t, func() bool { return slow.Stats().Delivered == 1 && fast.Stats().Delivered >= 1 })
+	err = b.Unsubscribe(slow)
+	test.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		d := <-fast.C
+		test.Equals(t, d.id, i)
+	}
+	test.Equals(t, slow.Stats(), ListenerStats{Delivered: 1})
+}
+
+func TestPolicyWait(t *testing.T) {
+	b := NewAndStart[data](context.Background())
+	defer func() {
+		err := b.Stop()
+		test.Nil(t, err)
+	}()
+	stalled, err := b.Subscribe(WithWait(50 * time.Millisecond))
+	test.Nil(t, err)
+	fast, err := b.Subscribe(WithBufferSize(10))
+	test.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		err := b.WriteSync(data{id: i})
+		test.Nil(t, err)
+	}
+	// stalled never receives, so it only delays the delivery to fast
+	for i := 0; i < 3; i++ {
+		d := <-fast.C
+		test.Equals(t, d.id, i)
+	}
+	eventually(t, func() bool { return stalled.Stats().Dropped == 2 })
+	test.Equals(t, stalled.Stats(), ListenerStats{Delivered: 1, Dropped: 2})
+	subscribed, err := b.IsSubscribed(stalled)
+	test.Nil(t, err)
+	test.Equals(t, subscribed, true)
+}
+
+func TestOrdered(t *testing.T) {
+	ctx := context.Background()
+	b := NewAndStart[data](ctx, WithOrdered(100))
+	defer func() {
+		err := b.Stop()
+		test.Nil(t, err)
+	}()
+	const messages = 1000
+	var w sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		l, err := b.Subscribe(WithBufferSize(10))
+		test.Nil(t, err)
+		w.Add(1)
+		go func() {
+			defer w.Done()
+			for i := 0; i < messages; i++ {
+				d := <-l.C
+				if d.id != i {
+					t.Errorf("expected %d got %d", i, d.id)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < messages; i++ {
+		err := b.WriteWait(ctx, data{id: i})
+		test.Nil(t, err)
+	}
+	w.Wait()
+}
+
+func TestOrderedBackpressure(t *testing.T) {
+	ctx := context.Background()
+	b := NewAndStart[data](ctx, WithOrdered(2))
+	defer func() {
+		err := b.Stop()
+		test.Nil(t, err)
+	}()
+	l, err := b.Subscribe(WithPolicy(PolicyBlock))
+	test.Nil(t, err)
+	// the listener does not read, so the queue fills up and the writes wait
+	accepted := 0
+	for ; accepted < 10; accepted++ {
+		tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		err := b.WriteWait(tctx, data{id: accepted})
+		cancel()
+		if err != nil {
+			test.ErrorIs(t, err, context.DeadlineExceeded)
+			break
+		}
+	}
+	test.Equals(t, accepted < 10, true)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- b.WriteWait(ctx, data{id: accepted})
+	}()
+	for i := 0; i <= accepted; i++ {
+		d := <-l.C
+		test.Equals(t, d.id, i)
+	}
+	test.Nil(t, <-errc)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = b.WriteWait(canceled, data{})
+	test.ErrorIs(t, err, context.Canceled)
+}
+
+func TestOrderedQueueFull(t *testing.T) {
+	ctx := context.Background()
+	b := NewAndStart[data](ctx, WithOrdered(2))
+	defer func() {
+		err := b.Stop()
+		test.Nil(t, err)
+	}()
+	l, err := b.Subscribe(WithPolicy(PolicyBlock))
+	test.Nil(t, err)
+	// the listener does not read, so the queue fills up
+	accepted := 0
+	for ; accepted < 10; accepted++ {
+		err := b.WriteCtx(ctx, data{id: accepted})
+		if err != nil {
+			test.ErrorIs(t, err, ErrQueueFull)
+			break
+		}
+	}
+	test.Equals(t, accepted < 10, true)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = b.WriteCtx(canceled, data{})
+	test.ErrorIs(t, err, context.Canceled)
+	for i := 0; i < accepted; i++ {
+		d := <-l.C
+		test.Equals(t, d.id, i)
+	}
+}
+
+func TestOrderedStopWrite(t *testing.T) {
+	b := NewAndStart[data](context.Background(), WithOrdered(1))
+	_, err := b.Subscribe(WithPolicy(PolicyBlock))
+	test.Nil(t, err)
+	var written atomic.Int64
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			if err := b.WriteWait(context.Background(), data{id: i}); err != nil {
+				errc <- err
+				return
+			}
+			written.Add(1)
+		}
+	}()
+	// the listener, the delivery and the queue hold one message each
+	eventually(t, func() bool { return written.Load() == 3 })
+	// the blocked write returns when the broadcaster stops
+	err = b.Stop()
+	test.Nil(t, err)
+	test.ErrorIs(t, <-errc, ErrStopped)
+}
+
+func TestTopics(t *testing.T) {
+	ctx := context.Background()
+	b := NewAndStart[data](ctx, WithOrdered(10), WithTopic(func(d data) string { return d.name }))
+	defer func() {
+		err := b.Stop()
+		test.Nil(t, err)
+	}()
+	subscribe := func(opts ...SubscribeOption) *Listener[data] {
+		l, err := b.Subscribe(append(opts, WithBufferSize(10))...)
+		test.Nil(t, err)
+		return l
+	}
+	all := subscribe()
+	exact := subscribe(WithTopics("orders.created"))
+	prefix := subscribe(WithTopics("orders.*"))
+	both := subscribe(WithTopics("orders.*", "orders.created", "users.deleted"))
+	wildcard := subscribe(WithTopics(Wildcard))
+	filtered := subscribe(WithTopics("orders.*"), WithFilter(func(d data) bool { return d.id%2 == 0 }))
+	messages := []data{
+		{id: 1, name: "orders.created"},
+		{id: 2, name: "orders.deleted"},
+		{id: 3, name: "users.created"},
+		{id: 4, name: "users.deleted"},
+		{id: 5, name: "orders"},
+	}
+	for _, m := range messages {
+		err := b.WriteCtx(ctx, m)
+		test.Nil(t, err)
+	}
+	// the last message reaches every listener, so the others were delivered
+	err := b.WriteCtx(ctx, data{id: 6, name: "orders.last"})
+	test.Nil(t, err)
+	received := func(l *Listener[data]) []int {
+		var ids []int
+		for {
+			d := <-l.C
+			if d.id == 6 {
+				return ids
+			}
+			ids = append(ids, d.id)
+		}
+	}
+	test.Equals(t, received(all), []int{1, 2, 3, 4, 5})
+	test.Equals(t, received(prefix), []int{1, 2})
+	test.Equals(t, received(both), []int{1, 2, 4})
+	test.Equals(t, received(wildcard), []int{1, 2, 3, 4, 5})
+	test.Equals(t, received(filtered), []int{2})
+	test.Equals(t, exact.Stats().Delivered, uint64(1))
+	test.Equals(t, (<-exact.C).id, 1)
+
+	err = b.Unsubscribe(prefix)
+	test.Nil(t, err)
+	err = b.WriteCtx(ctx, data{id: 7, name: "orders.created"})
+	test.Nil(t, err)
+	test.Equals(t, (<-exact.C).id, 7)
+	_, ok := <-prefix.C
+	test.Equals(t, ok, false)
+}
+
+func TestTopicsErrors(t *testing.T) {
+	b := NewAndStart[data](context.Background())
+	defer func() {
+		err := b.Stop()
+		test.Nil(t, err)
+	}()
+	_, err := b.Subscribe(WithTopics("orders"))
+	test.ErrorIs(t, err, ErrNoTopic)
+	_, err = b.Subscribe(WithFilter(func(string) bool { return true }))
+	test.ErrorIs(t, err, ErrFilter)
+}
+
+func TestSubscribeFrom(t *testing.T) {
+	ctx := context.Background()
+	b := NewAndStart[data](ctx, WithOrdered(10), WithRetention(3, 0))
+	defer func() {
+		err := b.Stop()
+		test.Nil(t, err)
+	}()
+	live, err := b.Subscribe(WithBufferSize(10))
+	test.Nil(t, err)
+	for i := 1; i <= 5; i++ {
+		err := b.WriteCtx(ctx, data{id: i})
+		test.Nil(t, err)
+	}
+	for i := 1; i <= 5; i++ {
+		<-live.C
+	}
+	test.Equals(t, b.LastSeq(), uint64(5))
+
+	_, err = b.SubscribeFrom(2)
+	test.ErrorIs(t, err, ErrEvicted)
+
+	l, err := b.SubscribeFrom(4)
+	test.Nil(t, err)
+	next, err := b.SubscribeFrom(0)
+	test.Nil(t, err)
+	err = b.WriteCtx(ctx, data{id: 6})
+	test.Nil(t, err)
+	for seq := uint64(4); seq <= 6; seq++ {
+		m := <-l.C
+		test.Equals(t, m.Seq, seq)
+		test.Equals(t, m.Value.id, int(seq))
+	}
+	m := <-next.C
+	test.Equals(t, m.Seq, uint64(6))
+
+	err = l.Close()
+	test.Nil(t, err)
+	_, ok := <-l.C
+	test.Equals(t, ok, false)
+}
+
+func TestSubscribeFromDuration(t *testing.T) {
+	ctx := context.Background()
+	b := NewAndStart[data](ctx, WithOrdered(10), WithRetention(0, 50*time.Millisecond),
+		WithTopic(func(d data) string { return d.name }))
+	defer func() {
+		err := b.Stop()
+		test.Nil(t, err)
+	}()
+	for i := 1; i <= 4; i++ {
+		err := b.WriteCtx(ctx, data{id: i, name: []string{"even", "odd"}[i%2]})
+		test.Nil(t, err)
+	}
+	eventually(t, func() bool { return b.LastSeq() == 4 })
+	l, err := b.SubscribeFrom(1, WithTopics("even"))
+	test.Nil(t, err)
+	test.Equals(t, (<-l.C).Seq, uint64(2))
+	test.Equals(t, (<-l.C).Seq, uint64(4))
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = b.SubscribeFrom(4)
+	test.ErrorIs(t, err, ErrEvicted)
+	// the next message is not retained yet, but it is not missed either
+	_, err = b.SubscribeFrom(5)
+	test.Nil(t, err)
+}
+
+func TestSubscribeFromStopped(t *testing.T) {
+	b := NewAndStart[data](context.Background())
+	err := b.Stop()
+	test.Nil(t, err)
+	_, err = b.SubscribeFrom(0)
+	test.ErrorIs(t, err, ErrStopped)
+}
+
+func TestDurable(t *testing.T) {
+	ctx := context.Background()
+	db, err := database.Open(ctx, filepath.Join(t.TempDir(), "db"), database.Option{InMemory: true})
+	test.Nil(t, err)
+	defer func() {
+		err := db.Close()
+		test.Nil(t, err)
+	}()
+	d, err := NewDurable[string](ctx, db, "events", WithVisibilityTimeout(100*time.Millisecond))
+	test.Nil(t, err)
+	for _, v := range []string{"a", "b", "c"} {
+		err := d.Write(ctx, v)
+		test.Nil(t, err)
+	}
+	l, err := d.Subscribe("g1", WithBufferSize(10))
+	test.Nil(t, err)
+	ms := make([]Delivery[string], 0, 3)
+	for i := 0; i < 3; i++ {
+		ms = append(ms, <-l.C)
+	}
+	test.Equals(t, ms[0].Value, "a")
+	test.Equals(t, ms[2].Seq, uint64(3))
+	test.Nil(t, ms[0].Ack())
+	test.Nil(t, ms[2].Ack())
+
+	// b is delivered again after the visibility timeout
+	m := <-l.C
+	test.Equals(t, m.Seq, uint64(2))
+	test.Equals(t, m.Attempt, 2)
+	err = d.Write(ctx, "d")
+	test.Nil(t, err)
+	m4 := <-l.C
+	test.Equals(t, m4.Value, "d")
+	test.Nil(t, m.Ack())
+	err = d.Stop()
+	test.Nil(t, err)
+	_, ok := <-l.C
+	test.Equals(t, ok, false)
+
+	// d was not acknowledged, so it is delivered after a restart
+	d, err = NewDurable[string](ctx, db, "events")
+	test.Nil(t, err)
+	defer func() {
+		err := d.Stop()
+		test.Nil(t, err)
+	}()
+	test.Equals(t, d.LastSeq(), uint64(4))
+	l, err = d.Subscribe("g1")
+	test.Nil(t, err)
+	m = <-l.C
+	test.Equals(t, m.Value, "d")
+	test.Equals(t, m.Attempt, 1)
+
+	// a, b and c were acknowledged by g1, the only group, and removed
+	l2, err := d.Subscribe("g2", WithBufferSize(10))
+	test.Nil(t, err)
+	m = <-l2.C
+	test.Equals(t, m.Value, "d")
+}
+
+type logRecord struct {
+	Seq   uint64
+	Value string
+}
+
+func (r logRecord) ID() string {
+	return fmt.Sprintf("%020d", r.Seq)
+}
+
+func TestDurableTrim(t *testing.T) {
+	ctx := context.Background()
+	db, err := database.Open(ctx, filepath.Join(t.TempDir(), "db"), database.Option{InMemory: true})
+	test.Nil(t, err)
+	defer func() {
+		err := db.Close()
+		test.Nil(t, err)
+	}()
+	log := database.NewTable(db, "broadcaster_log", "events", database.BinaryMarshaller[logRecord]{})
+	seqs := func() []uint64 {
+		rs, err := log.All()
+		test.Nil(t, err)
+		r := make([]uint64, 0, len(rs))
+		for _, rec := range rs {
+			r = append(r, rec.Seq)
+		}
+		return r
+	}
+	d, err := NewDurable[string](ctx, db, "events")
+	test.Nil(t, err)
+	l1, err := d.Subscribe("g1", WithBufferSize(10))
+	test.Nil(t, err)
+	l2, err := d.Subscribe("g2", WithBufferSize(10))
+	test.Nil(t, err)
+	for _, v := range []string{"a", "b", "c", "d"} {
+		err := d.Write(ctx, v)
+		test.Nil(t, err)
+	}
+	ack := func(l *Listener[Delivery[string]], n int) {
+		for i := 0; i < n; i++ {
+			m := <-l.C
+			test.Nil(t, m.Ack())
+		}
+	}
+	// g2 did not acknowledge any message
+	ack(l1, 4)
+	test.Equals(t, seqs(), []uint64{1, 2, 3, 4})
+	ack(l2, 2)
+	test.Equals(t, seqs(), []uint64{3, 4})
+	// the last message is kept
+	ack(l2, 2)
+	test.Equals(t, seqs(), []uint64{4})
+	err = d.Stop()
+	test.Nil(t, err)
+
+	d, err = NewDurable[string](ctx, db, "events")
+	test.Nil(t, err)
+	defer func() {
+		err := d.Stop()
+		test.Nil(t, err)
+	}()
+	test.Equals(t, d.LastSeq(), uint64(4))
+	l1, err = d.Subscribe("g1")
+	test.Nil(t, err)
+	err = d.Write(ctx, "e")
+	test.Nil(t, err)
+	m := <-l1.C
+	test.Equals(t, m.Seq, uint64(5))
+}
+
+func TestDurableTrimRestart(t *testing.T) {
+	ctx := context.Background()
+	db, err := database.Open(ctx, filepath.Join(t.TempDir(), "db"), database.Option{InMemory: true})
+	test.Nil(t, err)
+	defer func() {
+		err := db.Close()
+		test.Nil(t, err)
+	}()
+	d, err := NewDurable[string](ctx, db, "events")
+	test.Nil(t, err)
+	_, err = d.Subscribe("g1")
+	test.Nil(t, err)
+	_, err = d.Subscribe("g2")
+	test.Nil(t, err)
+	err = d.Stop()
+	test.Nil(t, err)
+
+	// g2 is not subscribed after the restart, so the log is retained for it
+	d, err = NewDurable[string](ctx, db, "events")
+	test.Nil(t, err)
+	defer func() {
+		err := d.Stop()
+		test.Nil(t, err)
+	}()
+	l1, err := d.Subscribe("g1", WithBufferSize(10))
+	test.Nil(t, err)
+	for _, v := range []string{"a", "b", "c"} {
+		err := d.Write(ctx, v)
+		test.Nil(t, err)
+	}
+	for i := 0; i < 3; i++ {
+		m := <-l1.C
+		test.Nil(t, m.Ack())
+	}
+	l2, err := d.Subscribe("g2", WithBufferSize(10))
+	test.Nil(t, err)
+	for _, v := range []string{"a", "b", "c"} {
+		m := <-l2.C
+		test.Equals(t, m.Value, v)
+	}
+}
+
+func TestDurableGroup(t *testing.T) {
+	ctx := context.Background()
+	db, err := database.Open(ctx, filepath.Join(t.TempDir(), "db"), database.Option{InMemory: true})
+	test.Nil(t, err)
+	defer func() {
+		err := db.Close()
+		test.Nil(t, err)
+	}()
+	d, err := NewDurable[string](ctx, db, "events")
+	test.Nil(t, err)
+	defer func() {
+		err := d.Stop()
+		test.Nil(t, err)
+	}()
+	_, err = d.Subscribe("g", WithTopics("t"))
+	test.ErrorIs(t, err, ErrNoTopic)
+	l1, err := d.Subscribe("g", WithBufferSize(10))
+	test.Nil(t, err)
+	l2, err := d.Subscribe("g", WithBufferSize(10))
+	test.Nil(t, err)
+	for i := 0; i < 4; i++ {
+		err := d.Write(ctx, "m")
+		test.Nil(t, err)
+	}
+	// the listeners of a group share the messages
+	seen := make(map[uint64]bool)
+	for len(seen) < 4 {
+		var m Delivery[string]
+		select {
+		case m = <-l1.C:
+		case m = <-l2.C:
+		}
+		test.Equals(t, seen[m.Seq], false)
+		seen[m.Seq] = true
+		test.Nil(t, m.Ack())
+	}
+	test.Equals(t, l1.Stats().Delivered+l2.Stats().Delivered, uint64(4))
+	err = l1.Close()
+	test.Nil(t, err)
+	err = d.Write(ctx, "n")
+	test.Nil(t, err)
+	m := <-l2.C
+	test.Equals(t, m.Seq, uint64(5))
+}
+
+func TestTelemetry(t *testing.T) {
+	ctx := context.Background()
+	reader := metric.NewManualReader()
+	provider := obs.NewWithProviders(nil, metric.NewMeterProvider(metric.WithReader(reader)))
+	b := NewAndStart[data](ctx, WithOrdered(10), WithName("events"), WithOtelProvider(provider))
+	l, err := b.Subscribe(WithPolicy(PolicyDropNewest))
+	test.Nil(t, err)
+	_, err = b.Subscribe(WithPolicy(PolicyDropNewest), WithBufferSize(10))
+	test.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		err := b.WriteCtx(ctx, data{id: i})
+		test.Nil(t, err)
+	}
+	eventually(t, func() bool { return b.LastSeq() == 3 })
+
+	var rm metricdata.ResourceMetrics
+	err = reader.Collect(ctx, &rm)
+	test.Nil(t, err)
+	points := make(map[string]int64)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch d := m.Data.(type) {
+			case metricdata.Histogram[float64]:
+				for _, p := range d.DataPoints {
+					points[m.Name] += int64(p.Count)
+				}
+			case metricdata.Sum[int64]:
+				for _, p := range d.DataPoints {
+					test.Equals(t, p.Attributes.Len(), 1)
+					points[m.Name] += p.Value
+				}
+			case metricdata.Gauge[int64]:
+				for _, p := range d.DataPoints {
+					// one series per broadcaster, whatever its listeners
+					test.Equals(t, p.Attributes.Len(), 1)
+					name, _ := p.Attributes.Value(attribute.Key("broadcaster.name"))
+					test.Equals(t, name.AsString(), "events")
+					points[m.Name] += p.Value
+				}
+			}
+		}
+	}
+	test.Equals(t, points["broadcaster.writes"], int64(3))
+	test.Equals(t, points["broadcaster.fanout.duration"], int64(3))
+	test.Equals(t, points["broadcaster.subscribers"], int64(2))
+	test.Equals(t, points["broadcaster.queue.depth"], int64(0))
+	test.Equals(t, points["broadcaster.listener.lag.max"], int64(3))
+	test.Equals(t, points["broadcaster.listener.dropped"], int64(2))
+	<-l.C
+	err = b.Stop()
+	test.Nil(t, err)
+}
+
+func eventually(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
 type listenerSync struct {
 	l *Listener[data]
 	b *Broadcaster[data]
@@ -0,0 +1,479 @@
+package broadcaster
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andrescosta/goico/pkg/database"
+	"github.com/rs/zerolog"
+)
+
+const (
+	logTable     = "broadcaster_log"
+	offsetsTable = "broadcaster_offsets"
+
+	defaultVisibilityTimeout = 30 * time.Second
+	// maxInFlight is the number of messages a group reads from the log
+	// before they are acknowledged.
+	maxInFlight = 1024
+)
+
+type DurableOption func(*durableOptions)
+
+type durableOptions struct {
+	visibilityTimeout time.Duration
+}
+
+// Durable is a broadcaster that appends the messages to a log in a database
+// and delivers them at least once to every consumer group. The listeners of
+// a group share its messages, which are delivered again when they are not
+// acknowledged within the visibility timeout. The messages acknowledged by
+// every group that was subscribed are removed from the log, except the last
+// one, so a group that is not used anymore retains the log from its offset.
+type Durable[T any] struct {
+	ctx               context.Context
+	cancel            context.CancelFunc
+	workers           *sync.WaitGroup
+	log               *database.Table[record[T]]
+	offsets           *database.Table[offset]
+	visibilityTimeout time.Duration
+	mu                sync.Mutex
+	stopped           bool
+	seq               uint64
+	groups            map[string]*group[T]
+	// trimmed is the last message removed from the log.
+	trimMu  sync.Mutex
+	trimmed uint64
+}
+
+// Delivery is a message delivered by a Durable broadcaster. Attempt is 1 the
+// first time it is delivered to the group.
+type Delivery[T any] struct {
+	Seq     uint64
+	Value   T
+	Attempt int
+	group   *group[T]
+}
+
+type record[T any] struct {
+	Seq   uint64
+	Value T
+}
+
+type offset struct {
+	Group string
+	Seq   uint64
+}
+
+// group tracks the messages of a consumer group. Every message up to
+// committed was acknowledged.
+type group[T any] struct {
+	d         *Durable[T]
+	name      string
+	mu        sync.Mutex
+	listeners []*Listener[Delivery[T]]
+	rr        int
+	next      uint64
+	committed uint64
+	inFlight  map[uint64]*pending[T]
+	acked     map[uint64]void
+	// saved is the committed offset stored in the database.
+	saveMu sync.Mutex
+	saved  uint64
+	wake   chan void
+}
+
+type pending[T any] struct {
+	value    T
+	attempt  int
+	deadline time.Time
+}
+
+// NewDurable opens the durable broadcaster name, stored in db, and resumes
+// its log.
+func NewDurable[T any](ctx context.Context, db *database.Database, name string, opts ...DurableOption) (*Durable[T], error) {
+	o := durableOptions{visibilityTimeout: defaultVisibilityTimeout}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	log := database.NewTable(db, logTable, name, database.BinaryMarshaller[record[T]]{})
+	last, err := log.Last()
+	if err != nil {
+		return nil, err
+	}
+	ctx1, cancel := context.WithCancel(ctx)
+	d := &Durable[T]{
+		ctx:               ctx1,
+		cancel:            cancel,
+		workers:           &sync.WaitGroup{},
+		log:               log,
+		offsets:           database.NewTable(db, offsetsTable, name, database.BinaryMarshaller[offset]{}),
+		visibilityTimeout: o.visibilityTimeout,
+		groups:            make(map[string]*group[T]),
+	}
+	if last != nil {
+		d.seq = last.Seq
+	}
+	return d, nil
+}
+
+// Write appends t to the log and returns once it is stored.
+func (d *Durable[T]) Write(ctx context.Context, t T) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		return ErrStopped
+	}
+	if err := d.log.Add(record[T]{Seq: d.seq + 1, Value: t}); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	d.seq++
+	groups := make([]*group[T], 0, len(d.groups))
+	for _, g := range d.groups {
+		groups = append(groups, g)
+	}
+	d.mu.Unlock()
+	for _, g := range groups {
+		g.notify()
+	}
+	return nil
+}
+
+// LastSeq returns the sequence number of the last message written.
+func (d *Durable[T]) LastSeq() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.seq
+}
+
+// Subscribe returns a listener of the consumer group. The group starts with
+// the first message not acknowledged, or with the first message retained in
+// the log the first time it is used. Topics and filters are not supported.
+// By default a message the listener has no room for within a second is
+// delivered again after the visibility timeout.
+func (d *Durable[T]) Subscribe(groupName string, opts ...SubscribeOption) (*Listener[Delivery[T]], error) {
+	s := subscription{
+		bufferSize: defaultBufferSize,
+		policy:     PolicyWait,
+		wait:       defaultWait,
+	}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	if len(s.topics) > 0 {
+		return nil, ErrNoTopic
+	}
+	if s.filter != nil {
+		return nil, ErrFilter
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		return nil, ErrStopped
+	}
+	g, ok := d.groups[groupName]
+	if !ok {
+		var err error
+		if g, err = d.newGroup(groupName); err != nil {
+			return nil, err
+		}
+		d.groups[groupName] = g
+		d.workers.Add(1)
+		go func() {
+			defer d.workers.Done()
+			g.run()
+		}()
+	}
+	l := startListener[Delivery[T]](s)
+	l.detach = func() error {
+		return g.unsubscribe(l)
+	}
+	g.mu.Lock()
+	g.listeners = append(g.listeners, l)
+	g.mu.Unlock()
+	g.notify()
+	return l, nil
+}
+
+// Stop stops the delivery and closes the listeners. The database is not
+// closed.
+func (d *Durable[T]) Stop() error {
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		return ErrStopped
+	}
+	d.stopped = true
+	d.mu.Unlock()
+	d.cancel()
+	d.workers.Wait()
+	for _, g := range d.groups {
+		g.mu.Lock()
+		ls := g.listeners
+		g.listeners = nil
+		g.mu.Unlock()
+		for _, l := range ls {
+			_ = l.stop()
+		}
+	}
+	return nil
+}
+
+func (d *Durable[T]) newGroup(name string) (*group[T], error) {
+	o, err := d.offsets.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	g := &group[T]{
+		d:        d,
+		name:     name,
+		inFlight: make(map[uint64]*pending[T]),
+		acked:    make(map[uint64]void),
+		wake:     make(chan void, 1),
+	}
+	if o != nil {
+		g.committed = o.Seq
+		g.saved = o.Seq
+	} else if err := d.offsets.Add(offset{Group: name}); err != nil {
+		// the log is retained for the group from now on, even after a
+		// restart without it
+		return nil, err
+	}
+	g.next = g.committed + 1
+	return g, nil
+}
+
+// Ack acknowledges the message, so it is not delivered again to the group.
+func (m Delivery[T]) Ack() error {
+	return m.group.ack(m.Seq)
+}
+
+func (g *group[T]) notify() {
+	select {
+	case g.wake <- void{}:
+	default:
+	}
+}
+
+// run delivers the messages of the group until the broadcaster is stopped.
+func (g *group[T]) run() {
+	for {
+		wait, err := g.dispatch()
+		if err != nil {
+			zerolog.Ctx(g.d.ctx).Error().Err(err).Str("group", g.name).Msg("broadcaster: error reading the log")
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-g.d.ctx.Done():
+			t.Stop()
+			return
+		case <-g.wake:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// dispatch delivers the messages whose visibility timeout expired and the new
+// ones. It returns how long to wait for the next expiration.
+func (g *group[T]) dispatch() (time.Duration, error) {
+	g.mu.Lock()
+	if len(g.listeners) == 0 {
+		g.mu.Unlock()
+		return g.d.visibilityTimeout, nil
+	}
+	now := time.Now()
+	var due []uint64
+	for seq, p := range g.inFlight {
+		if !p.deadline.After(now) {
+			due = append(due, seq)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i] < due[j] })
+	var err error
+	if n := maxInFlight - len(g.inFlight); n > 0 {
+		var rs []record[T]
+		rs, err = g.d.log.Range(seqID(g.next), n)
+		for _, r := range rs {
+			g.inFlight[r.Seq] = &pending[T]{value: r.Value}
+			due = append(due, r.Seq)
+			g.next = r.Seq + 1
+		}
+	}
+	g.mu.Unlock()
+	for _, seq := range due {
+		if g.d.ctx.Err() != nil {
+			return 0, nil
+		}
+		if !g.deliver(seq) {
+			break
+		}
+	}
+	return g.nextDeadline(), err
+}
+
+// deliver writes the message seq to the next listener. It returns false when
+// the group has no listeners.
+func (g *group[T]) deliver(seq uint64) bool {
+	g.mu.Lock()
+	p, ok := g.inFlight[seq]
+	if !ok {
+		g.mu.Unlock()
+		return true
+	}
+	if len(g.listeners) == 0 {
+		g.mu.Unlock()
+		return false
+	}
+	g.rr = (g.rr + 1) % len(g.listeners)
+	l := g.listeners[g.rr]
+	p.attempt++
+	p.deadline = time.Now().Add(g.d.visibilityTimeout)
+	m := Delivery[T]{Seq: seq, Value: p.value, Attempt: p.attempt, group: g}
+	g.mu.Unlock()
+	ok, _ = l.write(g.d.ctx, m)
+	if !ok {
+		// the message is delivered again when its timeout expires
+		if g.remove(l) {
+			l.markDisconnected()
+			_ = l.stop()
+		}
+	}
+	return true
+}
+
+func (g *group[T]) nextDeadline() time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	wait := g.d.visibilityTimeout
+	now := time.Now()
+	for _, p := range g.inFlight {
+		if p.attempt > 0 {
+			wait = min(wait, max(p.deadline.Sub(now), 0))
+		}
+	}
+	return wait
+}
+
+func (g *group[T]) ack(seq uint64) error {
+	if g.d.ctx.Err() != nil {
+		return ErrStopped
+	}
+	g.mu.Lock()
+	if _, ok := g.inFlight[seq]; !ok {
+		g.mu.Unlock()
+		return nil
+	}
+	delete(g.inFlight, seq)
+	g.acked[seq] = void{}
+	for {
+		if _, ok := g.acked[g.committed+1]; !ok {
+			break
+		}
+		delete(g.acked, g.committed+1)
+		g.committed++
+	}
+	committed := g.committed
+	g.mu.Unlock()
+	// there is room for the next messages of the log
+	g.notify()
+	g.saveMu.Lock()
+	defer g.saveMu.Unlock()
+	if committed <= g.saved {
+		return nil
+	}
+	if err := g.d.offsets.Update(offset{Group: g.name, Seq: committed}); err != nil {
+		return err
+	}
+	g.saved = committed
+	if err := g.d.trim(); err != nil {
+		zerolog.Ctx(g.d.ctx).Warn().Err(err).Msg("broadcaster: error trimming the log")
+	}
+	return nil
+}
+
+// trim removes the messages of the log acknowledged by every group, keeping
+// the last one so the sequence continues after a restart.
+func (d *Durable[T]) trim() error {
+	d.trimMu.Lock()
+	defer d.trimMu.Unlock()
+	stored, err := d.offsets.All()
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	var low uint64
+	if d.seq > 0 {
+		low = d.seq - 1
+	}
+	saved := make(map[string]void, len(stored))
+	for _, o := range stored {
+		saved[o.Group] = void{}
+		low = min(low, o.Seq)
+	}
+	for name := range d.groups {
+		// a group created after reading the offsets
+		if _, ok := saved[name]; !ok {
+			low = 0
+		}
+	}
+	d.mu.Unlock()
+	if low <= d.trimmed {
+		return nil
+	}
+	if err := d.log.DeleteRange(seqID(d.trimmed+1), seqID(low+1)); err != nil {
+		return err
+	}
+	d.trimmed = low
+	return nil
+}
+
+func (g *group[T]) remove(l *Listener[Delivery[T]]) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i, gl := range g.listeners {
+		if gl == l {
+			g.listeners = append(g.listeners[:i], g.listeners[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (g *group[T]) unsubscribe(l *Listener[Delivery[T]]) error {
+	if g.remove(l) {
+		_ = l.stop()
+	}
+	return nil
+}
+
+// seqID is the ID of seq in the log. It is padded so the IDs are ordered by
+// sequence.
+func seqID(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+func (r record[T]) ID() string {
+	return seqID(r.Seq)
+}
+
+func (o offset) ID() string {
+	return o.Group
+}
+
+// Setters
+
+// WithVisibilityTimeout sets how long a message waits for its acknowledgement
+// before it is delivered again. It is 30 seconds by default.
+func WithVisibilityTimeout(d time.Duration) DurableOption {
+	return func(o *durableOptions) {
+		o.visibilityTimeout = d
+	}
+}
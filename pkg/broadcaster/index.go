@@ -0,0 +1,203 @@
+package broadcaster
+
+import (
+	"strings"
+	"sync"
+)
+
+// Wildcard at the end of a topic matches every topic with that prefix.
+const Wildcard = "*"
+
+// index routes the messages to the listeners subscribed to their topic, so
+// delivery does not look at the other listeners. Listeners without topics
+// receive every message.
+type index[T any] struct {
+	mu       sync.RWMutex
+	topic    func(T) string
+	all      map[*Listener[T]]void
+	exact    map[string]map[*Listener[T]]void
+	prefixes *trie[T]
+	members  map[*Listener[T]]void
+}
+
+// trie indexes the listeners by the prefix of their wildcard topics.
+type trie[T any] struct {
+	children  map[byte]*trie[T]
+	listeners map[*Listener[T]]void
+}
+
+func newIndex[T any](topic func(T) string) *index[T] {
+	return &index[T]{
+		topic:    topic,
+		all:      make(map[*Listener[T]]void),
+		exact:    make(map[string]map[*Listener[T]]void),
+		prefixes: &trie[T]{},
+		members:  make(map[*Listener[T]]void),
+	}
+}
+
+func (x *index[T]) add(l *Listener[T]) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.members[l] = void{}
+	if len(l.topics) == 0 {
+		x.all[l] = void{}
+		return
+	}
+	for _, topic := range l.topics {
+		if prefix, ok := strings.CutSuffix(topic, Wildcard); ok {
+			x.prefixes.node(prefix, true).add(l)
+			continue
+		}
+		ls, ok := x.exact[topic]
+		if !ok {
+			ls = make(map[*Listener[T]]void)
+			x.exact[topic] = ls
+		}
+		ls[l] = void{}
+	}
+}
+
+// remove returns false if l is not subscribed.
+func (x *index[T]) remove(l *Listener[T]) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.members[l]; !ok {
+		return false
+	}
+	delete(x.members, l)
+	delete(x.all, l)
+	for _, topic := range l.topics {
+		if prefix, ok := strings.CutSuffix(topic, Wildcard); ok {
+			if n := x.prefixes.node(prefix, false); n != nil {
+				delete(n.listeners, l)
+			}
+			continue
+		}
+		if ls, ok := x.exact[topic]; ok {
+			delete(ls, l)
+			if len(ls) == 0 {
+				delete(x.exact, topic)
+			}
+		}
+	}
+	return true
+}
+
+func (x *index[T]) contains(l *Listener[T]) bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	_, ok := x.members[l]
+	return ok
+}
+
+// list returns every listener.
+func (x *index[T]) list() []*Listener[T] {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	ls := make([]*Listener[T], 0, len(x.members))
+	for l := range x.members {
+		ls = append(ls, l)
+	}
+	return ls
+}
+
+// removeAll removes and returns every listener.
+func (x *index[T]) removeAll() []*Listener[T] {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	ls := make([]*Listener[T], 0, len(x.members))
+	for l := range x.members {
+		ls = append(ls, l)
+	}
+	x.all = make(map[*Listener[T]]void)
+	x.exact = make(map[string]map[*Listener[T]]void)
+	x.prefixes = &trie[T]{}
+	x.members = make(map[*Listener[T]]void)
+	return ls
+}
+
+// match returns the listeners of t. Their filters are not evaluated.
+func (x *index[T]) match(t T) []*Listener[T] {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	ls := make([]*Listener[T], 0, len(x.all))
+	for l := range x.all {
+		ls = append(ls, l)
+	}
+	if x.topic == nil {
+		return ls
+	}
+	topic := x.topic(t)
+	// a listener can match t by more than one of its topics
+	var seen map[*Listener[T]]void
+	addAll := func(m map[*Listener[T]]void) {
+		for l := range m {
+			if len(l.topics) > 1 {
+				if seen == nil {
+					seen = make(map[*Listener[T]]void)
+				}
+				if _, ok := seen[l]; ok {
+					continue
+				}
+				seen[l] = void{}
+			}
+			ls = append(ls, l)
+		}
+	}
+	addAll(x.exact[topic])
+	n := x.prefixes
+	for i := 0; n != nil; i++ {
+		addAll(n.listeners)
+		if i == len(topic) {
+			break
+		}
+		n = n.children[topic[i]]
+	}
+	return ls
+}
+
+// matches reports whether l is subscribed to the topic of t.
+func (x *index[T]) matches(l *Listener[T], t T) bool {
+	if len(l.topics) == 0 {
+		return true
+	}
+	topic := x.topic(t)
+	for _, lt := range l.topics {
+		if prefix, ok := strings.CutSuffix(lt, Wildcard); ok {
+			if strings.HasPrefix(topic, prefix) {
+				return true
+			}
+		} else if lt == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// node returns the node of prefix, creating the missing ones when create is
+// set.
+func (n *trie[T]) node(prefix string, create bool) *trie[T] {
+	for i := 0; i < len(prefix); i++ {
+		child, ok := n.children[prefix[i]]
+		if !ok {
+			if !create {
+				return nil
+			}
+			if n.children == nil {
+				n.children = make(map[byte]*trie[T])
+			}
+			child = &trie[T]{}
+			n.children[prefix[i]] = child
+		}
+		n = child
+	}
+	return n
+}
+
+func (n *trie[T]) add(l *Listener[T]) {
+	if n.listeners == nil {
+		n.listeners = make(map[*Listener[T]]void)
+	}
+	n.listeners[l] = void{}
+}
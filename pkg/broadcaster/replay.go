@@ -0,0 +1,157 @@
+package broadcaster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrEvicted = errors.New("sequence is no longer retained")
+
+// Message is a message with its sequence number. The first message written
+// is number 1.
+type Message[T any] struct {
+	Seq   uint64
+	Value T
+}
+
+type retained[T any] struct {
+	seq uint64
+	t   T
+	at  time.Time
+}
+
+// replayRequest is a SubscribeFrom served by the worker, so the replay and
+// the live messages do not overlap or leave gaps.
+type replayRequest[T any] struct {
+	from uint64
+	s    subscription
+	done chan replayResult[T]
+}
+
+type replayResult[T any] struct {
+	l   *Listener[Message[T]]
+	err error
+}
+
+// peer is the listener that receives the messages of a SubscribeFrom
+// listener.
+type peer interface {
+	stop() error
+	markDisconnected()
+	lag() int
+	Stats() ListenerStats
+}
+
+// LastSeq returns the sequence number of the last message delivered.
+func (b *Broadcaster[T]) LastSeq() uint64 {
+	return b.lastSeq.Load()
+}
+
+// SubscribeFrom returns a listener that receives the retained messages from
+// seq on and then the new ones, with their sequence numbers. Zero starts with
+// the next message. It returns ErrEvicted when messages from seq on are no
+// longer retained.
+func (b *Broadcaster[T]) SubscribeFrom(seq uint64, opts ...SubscribeOption) (*Listener[Message[T]], error) {
+	b.statusBarrier.Entering()
+	defer b.statusBarrier.Out()
+	if b.statusBarrier.IsStopped() {
+		return nil, ErrStopped
+	}
+	s, err := b.subscription(opts)
+	if err != nil {
+		return nil, err
+	}
+	r := replayRequest[T]{from: seq, s: s, done: make(chan replayResult[T], 1)}
+	select {
+	case b.replays <- r:
+	case <-b.ctx.Done():
+		return nil, ErrStopped
+	}
+	select {
+	case res := <-r.done:
+		return res.l, res.err
+	case <-b.ctx.Done():
+		return nil, ErrStopped
+	}
+}
+
+// retain assigns the next sequence number to t and keeps it while it is
+// within the retention window. It is called by the worker.
+func (b *Broadcaster[T]) retain(t T) uint64 {
+	b.seq++
+	if b.retainN > 0 || b.retainD > 0 {
+		now := time.Now()
+		b.retained = append(b.retained, retained[T]{seq: b.seq, t: t, at: now})
+		b.evict(now)
+	}
+	return b.seq
+}
+
+func (b *Broadcaster[T]) evict(now time.Time) {
+	n := 0
+	for n < len(b.retained) {
+		if (b.retainN > 0 && len(b.retained)-n > b.retainN) ||
+			(b.retainD > 0 && now.Sub(b.retained[n].at) > b.retainD) {
+			n++
+			continue
+		}
+		break
+	}
+	if n > 0 {
+		clear(b.retained[:n])
+		b.retained = b.retained[n:]
+	}
+}
+
+// replay subscribes the listener of r and writes it the retained messages.
+// It is called by the worker, before the next message is delivered.
+func (b *Broadcaster[T]) replay(r replayRequest[T]) (*Listener[Message[T]], error) {
+	b.evict(time.Now())
+	from := r.from
+	if from == 0 {
+		from = b.seq + 1
+	}
+	var backlog []retained[T]
+	if from <= b.seq {
+		if len(b.retained) == 0 || b.retained[0].seq > from {
+			return nil, fmt.Errorf("%w: %d", ErrEvicted, from)
+		}
+		backlog = b.retained[from-b.retained[0].seq:]
+	}
+	l := startListener[T](subscription{bufferSize: 1, topics: r.s.topics, filter: r.s.filter})
+	// room for the backlog, so the replay does not wait for the receiver
+	ms := r.s
+	ms.bufferSize += len(backlog)
+	ms.topics, ms.filter = nil, nil
+	ml := startListener[Message[T]](ms)
+	ml.detach = func() error {
+		return b.Unsubscribe(l)
+	}
+	l.peer = ml
+	l.from = from
+	l.fwd = func(ctx context.Context, seq uint64, t T) (bool, error) {
+		return ml.write(ctx, Message[T]{Seq: seq, Value: t})
+	}
+	for _, m := range backlog {
+		if !b.listeners.matches(l, m.t) || (l.filter != nil && !l.filter(m.t)) {
+			continue
+		}
+		_, _ = ml.write(b.ctx, Message[T]{Seq: m.seq, Value: m.t})
+	}
+	b.listeners.add(l)
+	return ml, nil
+}
+
+// Setters
+
+// WithRetention keeps the last n messages, or the messages of the last d, to
+// replay them with SubscribeFrom. Zero values disable the limit, but at least
+// one must be set.
+func WithRetention(n int, d time.Duration) Option {
+	return func(o *options) {
+		o.retainN = n
+		o.retainD = d
+	}
+}
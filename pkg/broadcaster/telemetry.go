@@ -0,0 +1,92 @@
+package broadcaster
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/andrescosta/goico/pkg/service/obs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const instrumentationName = "github.com/andrescosta/goico/pkg/broadcaster"
+
+// telemetry holds the instruments of a broadcaster. When no provider is
+// configured they are no-ops. The metrics of the listeners are aggregated, so
+// the series do not grow with the subscriptions.
+type telemetry struct {
+	attrs        metric.MeasurementOption
+	writes       metric.Int64Counter
+	dropped      metric.Int64Counter
+	fanout       metric.Float64Histogram
+	registration metric.Registration
+}
+
+func newTelemetry[T any](b *Broadcaster[T], provider *obs.OtelProvider, name string) (*telemetry, error) {
+	meter := provider.Meter(instrumentationName)
+	t := &telemetry{
+		attrs: metric.WithAttributes(attribute.String("broadcaster.name", name)),
+	}
+	var err, errs error
+	t.writes, err = meter.Int64Counter("broadcaster.writes",
+		metric.WithDescription("Messages written to the broadcaster."),
+		metric.WithUnit("{message}"))
+	errs = errors.Join(errs, err)
+	t.fanout, err = meter.Float64Histogram("broadcaster.fanout.duration",
+		metric.WithDescription("Duration of the delivery of a message to its listeners."),
+		metric.WithUnit("s"))
+	errs = errors.Join(errs, err)
+	subscribers, err := meter.Int64ObservableGauge("broadcaster.subscribers",
+		metric.WithDescription("Subscribed listeners."),
+		metric.WithUnit("{listener}"))
+	errs = errors.Join(errs, err)
+	depth, err := meter.Int64ObservableGauge("broadcaster.queue.depth",
+		metric.WithDescription("Messages written and waiting for the delivery."),
+		metric.WithUnit("{message}"))
+	errs = errors.Join(errs, err)
+	lag, err := meter.Int64ObservableGauge("broadcaster.listener.lag.max",
+		metric.WithDescription("Largest number of messages delivered to a listener and not received yet."),
+		metric.WithUnit("{message}"))
+	errs = errors.Join(errs, err)
+	t.dropped, err = meter.Int64Counter("broadcaster.listener.dropped",
+		metric.WithDescription("Messages the listeners dropped because they did not keep up."),
+		metric.WithUnit("{message}"))
+	errs = errors.Join(errs, err)
+	if errs != nil {
+		return nil, errs
+	}
+	t.registration, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		ls := b.listeners.list()
+		o.ObserveInt64(subscribers, int64(len(ls)), t.attrs)
+		o.ObserveInt64(depth, int64(len(b.c)), t.attrs)
+		n := 0
+		for _, l := range ls {
+			if l.peer != nil {
+				n = max(n, l.peer.lag())
+			} else {
+				n = max(n, l.lag())
+			}
+		}
+		o.ObserveInt64(lag, int64(n), t.attrs)
+		return nil
+	}, subscribers, depth, lag)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// recordFanout records a message written, the duration of its delivery,
+// which started at start, and the messages the listeners dropped.
+func (t *telemetry) recordFanout(ctx context.Context, start time.Time, dropped uint64) {
+	t.writes.Add(ctx, 1, t.attrs)
+	t.fanout.Record(ctx, time.Since(start).Seconds(), t.attrs)
+	if dropped > 0 {
+		t.dropped.Add(ctx, int64(dropped), t.attrs)
+	}
+}
+
+func (t *telemetry) close() error {
+	return t.registration.Unregister()
+}
@@ -113,6 +113,45 @@ func TestOperations(t *testing.T) {
 	}
 }
 
+func TestRange(t *testing.T) {
+	t.Parallel()
+	db, err := Open(context.Background(), filepath.Join(t.TempDir(), "database"), Option{InMemory: true})
+	test.Nil(t, err)
+	defer func() {
+		err := db.Close()
+		test.Nil(t, err)
+	}()
+	table := NewTable(db, "range", tenant, BinaryMarshaller[data]{})
+	last, err := table.Last()
+	test.Nil(t, err)
+	test.Equals(t, last, (*data)(nil))
+	for _, id := range []string{"c", "a", "d", "b"} {
+		err := table.Add(data{Idd: id})
+		test.Nil(t, err)
+	}
+	ids := func(ds []data) []string {
+		r := make([]string, 0, len(ds))
+		for _, d := range ds {
+			r = append(r, d.Idd)
+		}
+		return r
+	}
+	ds, err := table.Range("b", 2)
+	test.Nil(t, err)
+	test.Equals(t, ids(ds), []string{"b", "c"})
+	ds, err = table.Range("b", 0)
+	test.Nil(t, err)
+	test.Equals(t, ids(ds), []string{"b", "c", "d"})
+	last, err = table.Last()
+	test.Nil(t, err)
+	test.Equals(t, last.Idd, "d")
+	err = table.DeleteRange("a", "c")
+	test.Nil(t, err)
+	ds, err = table.All()
+	test.Nil(t, err)
+	test.Equals(t, ids(ds), []string{"c", "d"})
+}
+
 func TestMarshallerError(t *testing.T) {
 	t.Parallel()
 	scenariosErrors := []*scenario{
@@ -58,6 +58,12 @@ func (s *Table[S]) Delete(id string) error {
 	return s.db.db.Delete(k.encode(), pebble.Sync)
 }
 
+// DeleteRange deletes the values with an ID greater than or equal to from
+// and less than to.
+func (s *Table[S]) DeleteRange(from, to string) error {
+	return s.db.db.DeleteRange(s.getKey(from).encode(), s.getKey(to).encode(), pebble.Sync)
+}
+
 func (s *Table[S]) Get(id string) (*S, error) {
 	k := s.getKey(id)
 	value, closer, err := s.db.db.Get(k.encode())
@@ -82,31 +88,50 @@ func (s *Table[S]) Get(id string) (*S, error) {
 }
 
 func (s *Table[S]) All() ([]S, error) {
-	var data []S
-	data = make([]S, 0)
+	k := s.getKey("")
+	return s.scan(prefixIterOptions(k.encodepreffix()), 0)
+}
 
+// Range returns up to n values, or every value if n is 0, with an ID greater
+// than or equal to from, ordered by ID.
+func (s *Table[S]) Range(from string, n int) ([]S, error) {
 	k := s.getKey("")
+	opts := prefixIterOptions(k.encodepreffix())
+	opts.LowerBound = s.getKey(from).encode()
+	return s.scan(opts, n)
+}
 
-	keyUpperBound := func(b []byte) []byte {
-		end := make([]byte, len(b))
-		copy(end, b)
-		for i := len(end) - 1; i >= 0; i-- {
-			end[i] = end[i] + 1
-			if end[i] != 0 {
-				return end[:i+1]
-			}
-		}
-		return nil // no upper-bound
+// Last returns the value with the greatest ID, or nil if the table is empty.
+func (s *Table[S]) Last() (*S, error) {
+	k := s.getKey("")
+	iter, err := s.db.db.NewIter(prefixIterOptions(k.encodepreffix()))
+	if err != nil {
+		return nil, err
 	}
-
-	prefixIterOptions := func(prefix []byte) *pebble.IterOptions {
-		return &pebble.IterOptions{
-			LowerBound: prefix,
-			UpperBound: keyUpperBound(prefix),
+	errs := make([]error, 0)
+	var last *S
+	if iter.Last() {
+		e, err := s.marshaler.Unmarshal(iter.Value())
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			last = &e
 		}
 	}
+	if err := iter.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return last, nil
+}
+
+func (s *Table[S]) scan(opts *pebble.IterOptions, n int) ([]S, error) {
+	var data []S
+	data = make([]S, 0)
 	errs := make([]error, 0)
-	iter, err := s.db.db.NewIter(prefixIterOptions(k.encodepreffix()))
+	iter, err := s.db.db.NewIter(opts)
 	if err != nil {
 		return nil, err
 	}
@@ -117,6 +142,9 @@ func (s *Table[S]) All() ([]S, error) {
 			break
 		}
 		data = append(data, d)
+		if n > 0 && len(data) == n {
+			break
+		}
 	}
 	if err := iter.Close(); err != nil {
 		errs = append(errs, err)
@@ -127,6 +155,25 @@ func (s *Table[S]) All() ([]S, error) {
 	return data, nil
 }
 
+func keyUpperBound(b []byte) []byte {
+	end := make([]byte, len(b))
+	copy(end, b)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i] = end[i] + 1
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil // no upper-bound
+}
+
+func prefixIterOptions(prefix []byte) *pebble.IterOptions {
+	return &pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: keyUpperBound(prefix),
+	}
+}
+
 func (s *Table[S]) getKey(id string) *Key {
 	return &Key{
 		version: []byte("0"),
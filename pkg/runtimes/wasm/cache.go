@@ -0,0 +1,291 @@
+package wasm
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/rs/zerolog"
+	"github.com/tetratelabs/wazero"
+)
+
+const (
+	lockFileName  = "LOCK"
+	lockRetryWait = 10 * time.Millisecond
+)
+
+// compilationCache stores the compiled code of every module in its own
+// directory named after the module hash. wazero adds a subdirectory per
+// version, so upgrades never read incompatible entries.
+//
+// The directories are evicted in least recently used order when the cache
+// grows beyond maxSize. Writes and evictions hold an exclusive lock on a file
+// of the cache directory, so several processes can share it.
+type compilationCache struct {
+	dir     string
+	maxSize int64
+	// mu protects caches and serializes the holders of the file lock inside
+	// this process.
+	mu     sync.Mutex
+	caches map[string]wazero.CompilationCache
+	// compiled are the modules already compiled by this process, which
+	// evicted the old entries then.
+	compiled map[string]bool
+}
+
+func newCompilationCache(dir string, maxSize int64) *compilationCache {
+	return &compilationCache{
+		dir:      dir,
+		maxSize:  maxSize,
+		caches:   make(map[string]wazero.CompilationCache),
+		compiled: make(map[string]bool),
+	}
+}
+
+// get returns the wazero cache of the module and marks it as recently used.
+func (c *compilationCache) get(hash string) (wazero.CompilationCache, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dir := filepath.Join(c.dir, hash)
+	now := time.Now()
+	if err := os.Chtimes(dir, now, now); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if cache, ok := c.caches[hash]; ok {
+		return cache, nil
+	}
+	cache, err := wazero.NewCompilationCacheWithDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	c.caches[hash] = cache
+	return cache, nil
+}
+
+// lock acquires the cache lock. It blocks until other processes release it
+// or ctx is done.
+func (c *compilationCache) lock(ctx context.Context) (func(), error) {
+	c.mu.Lock()
+	for {
+		l, err := vfs.Default.Lock(filepath.Join(c.dir, lockFileName))
+		if err == nil {
+			return func() {
+				if err := l.Close(); err != nil {
+					zerolog.Ctx(ctx).Warn().AnErr("err", err).Msg("compilationCache: error releasing lock")
+				}
+				c.mu.Unlock()
+			}, nil
+		}
+		select {
+		case <-ctx.Done():
+			c.mu.Unlock()
+			return nil, errors.Join(ctx.Err(), err)
+		case <-time.After(lockRetryWait):
+		}
+	}
+}
+
+// compile compiles the module with the lock held, so the entries written are
+// visible to other processes only when complete. A module compiled before
+// takes the lock too, as another process may have evicted its entry, which
+// wazero writes again. Old entries are evicted after the first compilation
+// of the module.
+func (c *compilationCache) compile(ctx context.Context, r wazero.Runtime, wasmModule []byte) (wazero.CompiledModule, error) {
+	hash := Hash(wasmModule)
+	unlock, err := c.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := c.restore(ctx, hash); err != nil {
+		return nil, err
+	}
+	m, err := r.CompileModule(ctx, wasmModule)
+	if err != nil {
+		return nil, err
+	}
+	if c.compiled[hash] {
+		return m, nil
+	}
+	c.compiled[hash] = true
+	if err := c.evict(hash); err != nil {
+		zerolog.Ctx(ctx).Warn().AnErr("err", err).Msg("compilationCache: error evicting entries")
+	}
+	return m, nil
+}
+
+// restore creates again the directory of the module when another process
+// evicted it, as wazero writes the entries into the directory created with
+// the cache. It must be called with the lock held.
+func (c *compilationCache) restore(ctx context.Context, hash string) error {
+	dir := filepath.Join(c.dir, hash)
+	_, err := os.Stat(dir)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	cache, err := wazero.NewCompilationCacheWithDir(dir)
+	if err != nil {
+		return err
+	}
+	return cache.Close(ctx)
+}
+
+type cacheEntry struct {
+	hash    string
+	size    int64
+	lastUse time.Time
+}
+
+// evict removes the least recently used entries until the cache fits in
+// maxSize, except the entry of the module keep. Modules compiled by this
+// process stay in memory, so only other processes recompile evicted
+// entries. It must be called with the lock held.
+func (c *compilationCache) evict(keep string) error {
+	if c.maxSize <= 0 {
+		return nil
+	}
+	entries, total, err := c.entries()
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].lastUse.Before(entries[j].lastUse) })
+	for _, e := range entries {
+		if total <= c.maxSize {
+			break
+		}
+		if e.hash == keep {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(c.dir, e.hash)); err != nil {
+			return err
+		}
+		total -= e.size
+	}
+	return nil
+}
+
+func (c *compilationCache) entries() ([]cacheEntry, int64, error) {
+	dirs, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	var total int64
+	entries := make([]cacheEntry, 0, len(dirs))
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil, 0, err
+		}
+		size, err := dirSize(filepath.Join(c.dir, d.Name()))
+		if err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, cacheEntry{hash: d.Name(), size: size, lastUse: info.ModTime()})
+		total += size
+	}
+	return entries, total, nil
+}
+
+// size returns the bytes used by the cache.
+func (c *compilationCache) size() (int64, error) {
+	_, total, err := c.entries()
+	return total, err
+}
+
+func (c *compilationCache) close(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var errs error
+	for hash, cache := range c.caches {
+		errs = errors.Join(errs, cache.Close(ctx))
+		delete(c.caches, hash)
+	}
+	return errs
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// removed by another process
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// Precompile compiles the modules into the cache of the runtime, so the
+// processes sharing a persistent cache directory do not compile them again.
+func (r *Runtime) Precompile(ctx context.Context, wasmModules ...[]byte) error {
+	var errs error
+	for _, wasmModule := range wasmModules {
+		errs = errors.Join(errs, r.precompile(ctx, wasmModule))
+	}
+	return errs
+}
+
+func (r *Runtime) precompile(ctx context.Context, wasmModule []byte) error {
+	config, err := r.config(wasmModule)
+	if err != nil {
+		return err
+	}
+	wr := wazero.NewRuntimeWithConfig(ctx, config)
+	defer wr.Close(ctx)
+	compiled, err := r.compile(ctx, wr, wasmModule)
+	if err != nil {
+		return errors.Join(ErrInvalidModule, err)
+	}
+	return compiled.Close(ctx)
+}
+
+// CacheSize returns the bytes used by the compilation cache.
+func (r *Runtime) CacheSize() (int64, error) {
+	if r.cache == nil {
+		return 0, nil
+	}
+	return r.cache.size()
+}
+
+// config returns the configuration for a wazero runtime that compiles the
+// module.
+func (r *Runtime) config(wasmModule []byte) (wazero.RuntimeConfig, error) {
+	if r.cache == nil {
+		return r.runtimeConfig, nil
+	}
+	cache, err := r.cache.get(Hash(wasmModule))
+	if err != nil {
+		return nil, err
+	}
+	return r.runtimeConfig.WithCompilationCache(cache), nil
+}
+
+func (r *Runtime) compile(ctx context.Context, wr wazero.Runtime, wasmModule []byte) (wazero.CompiledModule, error) {
+	if r.cache == nil {
+		return wr.CompileModule(ctx, wasmModule)
+	}
+	return r.cache.compile(ctx, wr, wasmModule)
+}
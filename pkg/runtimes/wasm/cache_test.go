@@ -0,0 +1,119 @@
+package wasm_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andrescosta/goico/pkg/runtimes/wasm"
+	"github.com/andrescosta/goico/pkg/test"
+)
+
+func TestPersistentCache(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	runtime, err := wasm.NewRuntimeWithCompilationCache(dir, wasm.WithPersistentCache())
+	test.Nil(t, err)
+	err = runtime.Precompile(ctx, echo, doerror)
+	test.Nil(t, err)
+	size, err := runtime.CacheSize()
+	test.Nil(t, err)
+	if size == 0 {
+		t.Errorf("expected cached modules")
+	}
+	err = runtime.Close(ctx)
+	test.Nil(t, err)
+	for _, m := range [][]byte{echo, doerror} {
+		_, err := os.Stat(filepath.Join(dir, wasm.Hash(m)))
+		test.Nil(t, err)
+	}
+
+	// a new runtime reads the entries written by the previous one
+	runtime, err = wasm.NewRuntimeWithCompilationCache(dir, wasm.WithPersistentCache())
+	test.Nil(t, err)
+	err = runtime.Precompile(ctx, echo)
+	test.Nil(t, err)
+	size2, err := runtime.CacheSize()
+	test.Nil(t, err)
+	test.Equals(t, size2, size)
+	err = runtime.Precompile(ctx, []byte("invalid"))
+	test.ErrorIs(t, err, wasm.ErrInvalidModule)
+	err = runtime.Close(ctx)
+	test.Nil(t, err)
+}
+
+func TestCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	runtime, err := wasm.NewRuntimeWithCompilationCache(dir, wasm.WithPersistentCache())
+	test.Nil(t, err)
+	err = runtime.Precompile(ctx, echo)
+	test.Nil(t, err)
+	size, err := runtime.CacheSize()
+	test.Nil(t, err)
+	err = runtime.Close(ctx)
+	test.Nil(t, err)
+	old := time.Now().Add(-time.Hour)
+	err = os.Chtimes(filepath.Join(dir, wasm.Hash(echo)), old, old)
+	test.Nil(t, err)
+
+	// several processes sharing the directory, only one module fits
+	var w sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		w.Add(1)
+		go func() {
+			defer w.Done()
+			runtime, err := wasm.NewRuntimeWithCompilationCache(dir, wasm.WithPersistentCache(), wasm.WithMaxCacheSize(size+size/2))
+			if err != nil {
+				t.Errorf("not expected error: %v", err)
+				return
+			}
+			defer runtime.Close(ctx)
+			if err := runtime.Precompile(ctx, doerror); err != nil {
+				t.Errorf("not expected error: %v", err)
+			}
+		}()
+	}
+	w.Wait()
+	_, err = os.Stat(filepath.Join(dir, wasm.Hash(echo)))
+	test.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(filepath.Join(dir, wasm.Hash(doerror)))
+	test.Nil(t, err)
+}
+
+func TestCacheEvictedEntry(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	runtime, err := wasm.NewRuntimeWithCompilationCache(dir, wasm.WithPersistentCache())
+	test.Nil(t, err)
+	defer func() {
+		err := runtime.Close(ctx)
+		test.Nil(t, err)
+	}()
+	err = runtime.Precompile(ctx, echo)
+	test.Nil(t, err)
+	// another process evicts the entry
+	err = os.RemoveAll(filepath.Join(dir, wasm.Hash(echo)))
+	test.Nil(t, err)
+	err = runtime.Precompile(ctx, echo)
+	test.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, wasm.Hash(echo)))
+	test.Nil(t, err)
+}
+
+func TestTemporaryCache(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	runtime, err := wasm.NewRuntimeWithCompilationCache(dir)
+	test.Nil(t, err)
+	err = runtime.Precompile(ctx, echo)
+	test.Nil(t, err)
+	err = runtime.Close(ctx)
+	test.Nil(t, err)
+	entries, err := os.ReadDir(dir)
+	test.Nil(t, err)
+	test.Len(t, entries, 0)
+}
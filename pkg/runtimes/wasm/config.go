@@ -0,0 +1,349 @@
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andrescosta/goico/pkg/service/obs"
+	"github.com/rs/zerolog"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// ModuleConfig describes the WASI environment a guest runs in. The zero value
+// gives the guest no env vars, no args, no filesystem and discards its
+// stdout and stderr.
+type ModuleConfig struct {
+	// Name and Version identify the module in traces and metrics.
+	Name    string
+	Version string
+	// Tenant owns the module. It is added to the traces and metrics.
+	Tenant string
+	Mode   ExecMode
+	Env    map[string]string
+	Args   []string
+	Mounts []Mount
+	Stdout io.Writer
+	Stderr io.Writer
+	// LogOutput routes stdout and stderr lines to the zerolog logger of the
+	// context passed to NewModule, when Stdout or Stderr are not set.
+	LogOutput  bool
+	Clock      *Clock
+	RandSource io.Reader
+	// MaxEmitBytes caps the bytes a guest can emit in a RunStream. Zero means
+	// no limit.
+	MaxEmitBytes int64
+	// OtelProvider exports the invocation spans and metrics. Nil disables them.
+	OtelProvider *obs.OtelProvider
+	// Verifier rejects the modules not signed by a trusted key. Nil accepts
+	// every module.
+	Verifier *Verifier
+	// Signature is the detached signature of the module. When it is nil the
+	// signature embedded in the module is verified.
+	Signature []byte
+	// MemoryLimits recycle the instance when its memory grows.
+	MemoryLimits MemoryLimits
+	// Recorder receives a recording of every execution, to be replayed with
+	// Replay. Nil disables the recording.
+	Recorder RecordFn
+	// Settings are the values the guest reads with config_get.
+	Settings map[string]Setting
+	// Secrets resolves the settings marked as secrets. Their values are
+	// redacted from the logs of the guest.
+	Secrets SecretProvider
+	// HTTPFetch enables the http_fetch host function. Nil leaves it out, so
+	// modules that import it fail to load.
+	HTTPFetch *HTTPFetchConfig
+	// Profiler records the guest and host calls of a sample of the
+	// invocations of the module. Nil disables the profiling.
+	Profiler *Profiler
+	tape     *tape
+}
+
+// Mount exposes the host directory HostDir to the guest at GuestDir.
+type Mount struct {
+	HostDir  string
+	GuestDir string
+	ReadOnly bool
+}
+
+type ModuleOption func(*ModuleConfig)
+
+// Clock is a deterministic clock. Every read returns the current time and then
+// advances it by the configured tick.
+type Clock struct {
+	mu   sync.Mutex
+	now  time.Time
+	nano int64
+	tick time.Duration
+}
+
+func NewClock(start time.Time, tick time.Duration) *Clock {
+	return &Clock{
+		now:  start,
+		tick: tick,
+	}
+}
+
+func (c *Clock) walltime() (int64, int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.now
+	c.now = c.now.Add(c.tick)
+	return t.Unix(), int32(t.Nanosecond())
+}
+
+func (c *Clock) nanotime() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.nano
+	c.nano += int64(c.tick)
+	return n
+}
+
+func newModuleConfig(opts []ModuleOption) *ModuleConfig {
+	c := &ModuleConfig{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *ModuleConfig) wazeroConfig(ctx context.Context) wazero.ModuleConfig {
+	cfg := wazero.NewModuleConfig()
+	keys := make([]string, 0, len(c.Env))
+	for k := range c.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		cfg = cfg.WithEnv(k, c.Env[k])
+	}
+	if len(c.Args) > 0 {
+		cfg = cfg.WithArgs(c.Args...)
+	}
+	if len(c.Mounts) > 0 {
+		fsConfig := wazero.NewFSConfig()
+		for _, m := range c.Mounts {
+			if m.ReadOnly {
+				fsConfig = fsConfig.WithReadOnlyDirMount(m.HostDir, m.GuestDir)
+			} else {
+				fsConfig = fsConfig.WithDirMount(m.HostDir, m.GuestDir)
+			}
+		}
+		cfg = cfg.WithFSConfig(fsConfig)
+	}
+	logger := zerolog.Ctx(ctx)
+	if c.Stdout != nil {
+		cfg = cfg.WithStdout(c.Stdout)
+	} else if c.LogOutput {
+		cfg = cfg.WithStdout(&logWriter{logger: logger, level: zerolog.InfoLevel, stream: "stdout"})
+	}
+	if c.Stderr != nil {
+		cfg = cfg.WithStderr(c.Stderr)
+	} else if c.LogOutput {
+		cfg = cfg.WithStderr(&logWriter{logger: logger, level: zerolog.ErrorLevel, stream: "stderr"})
+	}
+	if c.Clock != nil {
+		cfg = cfg.WithWalltime(c.Clock.walltime, sys.ClockResolution(1)).
+			WithNanotime(c.Clock.nanotime, sys.ClockResolution(1))
+	}
+	if c.RandSource != nil {
+		cfg = cfg.WithRandSource(c.RandSource)
+	}
+	return cfg
+}
+
+// logWriter writes every line it receives as a zerolog message.
+type logWriter struct {
+	mu     sync.Mutex
+	logger *zerolog.Logger
+	level  zerolog.Level
+	stream string
+	buf    bytes.Buffer
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// incomplete line, keep it until the rest arrives
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			return len(p), nil
+		}
+		w.logger.WithLevel(w.level).Str("stream", w.stream).Msg(line[:len(line)-1])
+	}
+}
+
+// Setters
+func WithName(name string) ModuleOption {
+	return func(c *ModuleConfig) {
+		c.Name = name
+	}
+}
+
+func WithVersion(version string) ModuleOption {
+	return func(c *ModuleConfig) {
+		c.Version = version
+	}
+}
+
+func WithTenant(tenant string) ModuleOption {
+	return func(c *ModuleConfig) {
+		c.Tenant = tenant
+	}
+}
+
+func WithMaxEmitBytes(n int64) ModuleOption {
+	return func(c *ModuleConfig) {
+		c.MaxEmitBytes = n
+	}
+}
+
+func WithOtelProvider(p *obs.OtelProvider) ModuleOption {
+	return func(c *ModuleConfig) {
+		c.OtelProvider = p
+	}
+}
+
+func WithVerifier(v *Verifier) ModuleOption {
+	return func(c *ModuleConfig) {
+		c.Verifier = v
+	}
+}
+
+func WithSignature(sig []byte) ModuleOption {
+	return func(c *ModuleConfig) {
+		c.Signature = sig
+	}
+}
+
+func WithMemoryLimits(l MemoryLimits) ModuleOption {
+	return func(c *ModuleConfig) {
+		c.MemoryLimits = l
+	}
+}
+
+func WithRecorder(fn RecordFn) ModuleOption {
+	return func(c *ModuleConfig) {
+		c.Recorder = fn
+	}
+}
+
+// WithSettings adds values the guest reads with config_get.
+func WithSettings(values map[string]string) ModuleOption {
+	return func(c *ModuleConfig) {
+		if c.Settings == nil {
+			c.Settings = make(map[string]Setting)
+		}
+		for k, v := range values {
+			c.Settings[k] = Setting{Value: v}
+		}
+	}
+}
+
+// WithSecret adds a setting whose value is resolved from ref by the
+// SecretProvider.
+func WithSecret(key, ref string) ModuleOption {
+	return func(c *ModuleConfig) {
+		if c.Settings == nil {
+			c.Settings = make(map[string]Setting)
+		}
+		c.Settings[key] = Setting{Value: ref, Secret: true}
+	}
+}
+
+func WithSecretProvider(p SecretProvider) ModuleOption {
+	return func(c *ModuleConfig) {
+		c.Secrets = p
+	}
+}
+
+func WithHTTPFetch(c *HTTPFetchConfig) ModuleOption {
+	return func(cfg *ModuleConfig) {
+		cfg.HTTPFetch = c
+	}
+}
+
+func WithProfiler(p *Profiler) ModuleOption {
+	return func(c *ModuleConfig) {
+		c.Profiler = p
+	}
+}
+
+func WithMode(mode ExecMode) ModuleOption {
+	return func(c *ModuleConfig) {
+		c.Mode = mode
+	}
+}
+
+func WithEnv(key, value string) ModuleOption {
+	return func(c *ModuleConfig) {
+		if c.Env == nil {
+			c.Env = make(map[string]string)
+		}
+		c.Env[key] = value
+	}
+}
+
+func WithArgs(args ...string) ModuleOption {
+	return func(c *ModuleConfig) {
+		c.Args = args
+	}
+}
+
+func WithDirMount(hostDir, guestDir string) ModuleOption {
+	return func(c *ModuleConfig) {
+		c.Mounts = append(c.Mounts, Mount{HostDir: hostDir, GuestDir: guestDir})
+	}
+}
+
+func WithReadOnlyDirMount(hostDir, guestDir string) ModuleOption {
+	return func(c *ModuleConfig) {
+		c.Mounts = append(c.Mounts, Mount{HostDir: hostDir, GuestDir: guestDir, ReadOnly: true})
+	}
+}
+
+func WithStdout(w io.Writer) ModuleOption {
+	return func(c *ModuleConfig) {
+		c.Stdout = w
+	}
+}
+
+func WithStderr(w io.Writer) ModuleOption {
+	return func(c *ModuleConfig) {
+		c.Stderr = w
+	}
+}
+
+func WithLogOutput() ModuleOption {
+	return func(c *ModuleConfig) {
+		c.LogOutput = true
+	}
+}
+
+func WithClock(clock *Clock) ModuleOption {
+	return func(c *ModuleConfig) {
+		c.Clock = clock
+	}
+}
+
+func WithRandSource(r io.Reader) ModuleOption {
+	return func(c *ModuleConfig) {
+		c.RandSource = r
+	}
+}
+
+func WithModuleConfig(config ModuleConfig) ModuleOption {
+	return func(c *ModuleConfig) {
+		*c = config
+	}
+}
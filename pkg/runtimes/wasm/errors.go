@@ -0,0 +1,193 @@
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+type ErrorKind uint32
+
+const (
+	// KindHost is a failure of the host: a host function that panicked or
+	// a guest that returned invalid memory references.
+	KindHost ErrorKind = iota
+	// KindExit is a guest that called proc_exit.
+	KindExit
+	// KindTrap is a guest that executed an invalid instruction.
+	KindTrap
+	// KindContext is an execution interrupted because the context was
+	// canceled or its deadline exceeded.
+	KindContext
+)
+
+type Trap string
+
+// Traps reported by the runtime.
+const (
+	TrapUnreachable          Trap = "unreachable"
+	TrapOutOfBounds          Trap = "out of bounds memory access"
+	TrapStackOverflow        Trap = "stack overflow"
+	TrapDivideByZero         Trap = "integer divide by zero"
+	TrapIntegerOverflow      Trap = "integer overflow"
+	TrapInvalidConversion    Trap = "invalid conversion to integer"
+	TrapInvalidTableAccess   Trap = "invalid table access"
+	TrapIndirectCallMismatch Trap = "indirect call type mismatch"
+)
+
+const (
+	wasmErrorPrefix  = "wasm error: "
+	stackTraceHeader = "\nwasm stack trace:\n"
+	omittedFrames    = "\t... maybe followed by omitted frames"
+)
+
+// ExecError is the error returned by Run when the execution of the guest
+// fails.
+type ExecError struct {
+	Kind ErrorKind
+	// Trap is set when Kind is KindTrap.
+	Trap Trap
+	// ExitCode is set when Kind is KindExit.
+	ExitCode uint32
+	// Frames is the guest stack trace, innermost frame first.
+	Frames []Frame
+	// Truncated reports that the runtime omitted the outermost frames.
+	Truncated bool
+	Err       error
+}
+
+// Frame is a function of the guest stack trace. Function is named after the
+// name section when present, otherwise after its index. Sources are the
+// source lines resolved from the DWARF sections.
+type Frame struct {
+	Function string
+	Sources  []string
+}
+
+func (e *ExecError) Error() string {
+	switch e.Kind {
+	case KindExit:
+		return fmt.Sprintf("wasm: guest exited with code %d", e.ExitCode)
+	case KindTrap:
+		return "wasm: trap: " + string(e.Trap)
+	case KindContext:
+		return "wasm: execution interrupted: " + e.Err.Error()
+	default:
+		return "wasm: host error: " + message(e.Err)
+	}
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// Stack returns the guest stack trace formatted one frame per line.
+func (e *ExecError) Stack() string {
+	var b strings.Builder
+	for _, f := range e.Frames {
+		b.WriteString(f.Function)
+		b.WriteByte('\n')
+		for _, s := range f.Sources {
+			b.WriteString("\t")
+			b.WriteString(s)
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+func (e *ExecError) MarshalZerologObject(ev *zerolog.Event) {
+	ev.Str("kind", e.Kind.String())
+	switch e.Kind {
+	case KindTrap:
+		ev.Str("trap", string(e.Trap))
+	case KindExit:
+		ev.Uint32("exit_code", e.ExitCode)
+	}
+	if len(e.Frames) > 0 {
+		ev.Str("stack", e.Stack())
+	}
+}
+
+func (k ErrorKind) String() string {
+	switch k {
+	case KindExit:
+		return "exit"
+	case KindTrap:
+		return "trap"
+	case KindContext:
+		return "context"
+	default:
+		return "host"
+	}
+}
+
+// newExecError classifies the error returned by the runtime.
+func newExecError(err error) *ExecError {
+	var execErr *ExecError
+	if errors.As(err, &execErr) {
+		return execErr
+	}
+	e := &ExecError{Kind: KindHost, Err: err}
+	var exitErr *sys.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		if isContextExit(exitErr) {
+			e.Kind = KindContext
+		} else {
+			e.Kind = KindExit
+			e.ExitCode = exitErr.ExitCode()
+		}
+		return e
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		e.Kind = KindContext
+		return e
+	}
+	msg := err.Error()
+	if strings.HasPrefix(msg, wasmErrorPrefix) {
+		e.Kind = KindTrap
+		e.Trap = Trap(message(err)[len(wasmErrorPrefix):])
+	}
+	e.Frames, e.Truncated = parseStackTrace(msg)
+	return e
+}
+
+// message returns the error message without the stack trace.
+func message(err error) string {
+	msg := err.Error()
+	if i := strings.Index(msg, stackTraceHeader); i >= 0 {
+		return msg[:i]
+	}
+	return msg
+}
+
+// parseStackTrace parses the stack trace that wazero appends to the errors.
+// Frames are indented with one tab and their source lines with two.
+func parseStackTrace(msg string) ([]Frame, bool) {
+	i := strings.Index(msg, stackTraceHeader)
+	if i < 0 {
+		return nil, false
+	}
+	var frames []Frame
+	for _, line := range strings.Split(msg[i+len(stackTraceHeader):], "\n") {
+		switch {
+		case line == omittedFrames:
+			return frames, true
+		case strings.HasPrefix(line, "\t\t"):
+			if len(frames) > 0 {
+				f := &frames[len(frames)-1]
+				f.Sources = append(f.Sources, strings.TrimPrefix(line, "\t\t"))
+			}
+		case strings.HasPrefix(line, "\t"):
+			frames = append(frames, Frame{Function: strings.TrimPrefix(line, "\t")})
+		default:
+			// end of the trace, e.g. the Go stack trace of a host panic
+			return frames, false
+		}
+	}
+	return frames, false
+}
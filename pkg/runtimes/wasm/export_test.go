@@ -0,0 +1,9 @@
+package wasm
+
+// NewInterpreterRuntime returns a Runtime backed by the wazero interpreter, so
+// tests do not depend on the compiler being supported by the Go toolchain.
+func NewInterpreterRuntime() *Runtime {
+	return NewRuntime(WithInterpreter())
+}
+
+var NewExecError = newExecError
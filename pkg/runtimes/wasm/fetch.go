@@ -0,0 +1,269 @@
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/andrescosta/goico/pkg/service"
+	"github.com/rs/zerolog"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// Values returned to the guest by http_fetch.
+const (
+	FetchOK uint32 = iota
+	// FetchDenied is returned when the host or the method is not allowed.
+	FetchDenied
+	// FetchTooLarge is returned when the request or the response exceed the
+	// size limits.
+	FetchTooLarge
+	FetchTimeout
+	// FetchFailed is returned when the request could not be sent or the
+	// response could not be read.
+	FetchFailed
+	// FetchInvalid is returned when the request could not be decoded.
+	FetchInvalid
+)
+
+const (
+	defaultFetchMaxBytes = 1 << 20
+	defaultFetchTimeout  = 10 * time.Second
+	maxFetchRedirects    = 10
+)
+
+var (
+	errRedirectDenied   = errors.New("redirect to a host or method not allowed")
+	errTooManyRedirects = errors.New("too many redirects")
+)
+
+// HTTPFetchConfig enables the http_fetch host function. The guest calls
+//
+//	http_fetch(req_ptr, req_len, res_ptr) -> status
+//
+// with a FetchRequest encoded in JSON. When status is FetchOK, the host writes
+// the pointer and length of the FetchResponse, encoded in JSON and allocated
+// with the malloc export of the guest, at res_ptr as two little endian
+// uint32. The guest must free it.
+type HTTPFetchConfig struct {
+	// Client builds the clients, by the host of the URL.
+	Client service.HTTPClientBuilder
+	// Allow are the hosts the guest can call. Requests, and redirects, to
+	// other hosts are denied.
+	Allow []AllowedHost
+	// MaxRequestBytes and MaxResponseBytes limit the size of the encoded
+	// request and of the body of the response. Zero means 1 MiB.
+	MaxRequestBytes  int64
+	MaxResponseBytes int64
+	// Timeout limits every request, replacing the timeout of the client.
+	// Zero means 10 seconds.
+	Timeout time.Duration
+}
+
+// AllowedHost is a host, with the port if it is not the default one of the
+// scheme, and the methods allowed for it. No methods allows only GET.
+type AllowedHost struct {
+	Host    string
+	Methods []string
+}
+
+// FetchRequest is the request the guest passes to http_fetch.
+type FetchRequest struct {
+	Method  string            `json:"method,omitempty"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    []byte            `json:"body,omitempty"`
+}
+
+// FetchResponse is the response http_fetch returns to the guest.
+type FetchResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    []byte            `json:"body,omitempty"`
+}
+
+// httpFetch is the http_fetch host function. Requests that fail are reported
+// to the guest with the status, invalid memory references abort the
+// execution.
+func (f *Module) httpFetch(ctx context.Context, m api.Module, offset, byteCount, resOffset uint32) uint32 {
+	buf, ok := m.Memory().Read(offset, byteCount)
+	if !ok {
+		panic(fmt.Errorf("Memory.Read(%d, %d) out of range", offset, byteCount))
+	}
+	req := bytes.Clone(buf)
+	var (
+		status uint32
+		res    []byte
+	)
+	if f.tape != nil {
+		status, res = f.tape.fetch(req, func() (uint32, []byte) {
+			return f.fetch(ctx, req)
+		})
+	} else {
+		status, res = f.fetch(ctx, req)
+	}
+	if status != FetchOK {
+		return status
+	}
+	if err := writeToGuest(ctx, m, resOffset, res); err != nil {
+		panic(err)
+	}
+	return FetchOK
+}
+
+// fetch sends the request and returns the status and the encoded response.
+func (f *Module) fetch(ctx context.Context, req []byte) (uint32, []byte) {
+	cfg := f.config.HTTPFetch
+	logger := zerolog.Ctx(ctx)
+	if int64(len(req)) > orDefault(cfg.MaxRequestBytes, defaultFetchMaxBytes) {
+		logger.Warn().Int("size", len(req)).Msg("http_fetch: request too large")
+		return FetchTooLarge, nil
+	}
+	var r FetchRequest
+	if err := json.Unmarshal(req, &r); err != nil {
+		logger.Warn().AnErr("err", err).Msg("http_fetch: invalid request")
+		return FetchInvalid, nil
+	}
+	if r.Method == "" {
+		r.Method = http.MethodGet
+	}
+	r.Method = strings.ToUpper(r.Method)
+	u, err := url.Parse(r.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		logger.Warn().Str("url", r.URL).Msg("http_fetch: invalid URL")
+		return FetchInvalid, nil
+	}
+	if !cfg.allowed(u, r.Method) {
+		logger.Warn().Str("host", u.Host).Str("method", r.Method).Msg("http_fetch: request denied")
+		return FetchDenied, nil
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultFetchTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	hreq, err := http.NewRequestWithContext(ctx, r.Method, u.String(), bytes.NewReader(r.Body))
+	if err != nil {
+		return FetchInvalid, nil
+	}
+	for k, v := range r.Headers {
+		hreq.Header.Set(k, v)
+	}
+	builder := cfg.Client
+	if builder == nil {
+		builder = service.DefaultHTTPClient
+	}
+	client, err := builder.NewHTTPClient(u.Host)
+	if err != nil {
+		logger.Warn().AnErr("err", err).Msg("http_fetch: error creating the client")
+		return FetchFailed, nil
+	}
+	// the client can be shared, so the settings of the call go in a copy
+	c := *client
+	c.Timeout = timeout
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxFetchRedirects {
+			return errTooManyRedirects
+		}
+		if !cfg.allowed(req.URL, req.Method) {
+			logger.Warn().Str("host", req.URL.Host).Str("method", req.Method).Msg("http_fetch: redirect denied")
+			return errRedirectDenied
+		}
+		return nil
+	}
+	hres, err := c.Do(hreq)
+	if err != nil {
+		return fetchError(ctx, err), nil
+	}
+	defer hres.Body.Close()
+	max := orDefault(cfg.MaxResponseBytes, defaultFetchMaxBytes)
+	body, err := io.ReadAll(io.LimitReader(hres.Body, max+1))
+	if err != nil {
+		return fetchError(ctx, err), nil
+	}
+	if int64(len(body)) > max {
+		logger.Warn().Str("host", u.Host).Msg("http_fetch: response too large")
+		return FetchTooLarge, nil
+	}
+	res := FetchResponse{
+		Status:  hres.StatusCode,
+		Headers: make(map[string]string, len(hres.Header)),
+		Body:    body,
+	}
+	for k := range hres.Header {
+		res.Headers[k] = hres.Header.Get(k)
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		return FetchFailed, nil
+	}
+	return FetchOK, b
+}
+
+// allowed reports whether the method is allowed for the host and port of u.
+// A host without port matches the default port of the scheme.
+func (c *HTTPFetchConfig) allowed(u *url.URL, method string) bool {
+	port := u.Port()
+	if port == "" {
+		port = defaultPort(u.Scheme)
+	}
+	for _, a := range c.Allow {
+		host, aport, err := net.SplitHostPort(a.Host)
+		if err != nil {
+			host, aport = strings.Trim(a.Host, "[]"), ""
+		}
+		if aport == "" {
+			aport = defaultPort(u.Scheme)
+		}
+		if !strings.EqualFold(host, u.Hostname()) || aport != port {
+			continue
+		}
+		if len(a.Methods) == 0 {
+			return method == http.MethodGet
+		}
+		for _, m := range a.Methods {
+			if strings.EqualFold(m, method) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func defaultPort(scheme string) string {
+	if scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+func fetchError(ctx context.Context, err error) uint32 {
+	if errors.Is(err, errRedirectDenied) {
+		return FetchDenied
+	}
+	zerolog.Ctx(ctx).Warn().AnErr("err", err).Msg("http_fetch: request failed")
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return FetchTimeout
+	}
+	var uerr *url.Error
+	if errors.As(err, &uerr) && uerr.Timeout() {
+		return FetchTimeout
+	}
+	return FetchFailed
+}
+
+func orDefault(v, d int64) int64 {
+	if v <= 0 {
+		return d
+	}
+	return v
+}
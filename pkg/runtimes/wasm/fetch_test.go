@@ -0,0 +1,232 @@
+package wasm_test
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrescosta/goico/pkg/runtimes/wasm"
+	"github.com/andrescosta/goico/pkg/test"
+)
+
+//go:embed testdata/fetch.wasm
+var fetchw []byte
+
+func TestHTTPFetch(t *testing.T) {
+	ctx := context.Background()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("not allowed"))
+	}))
+	defer other.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+			return
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/large":
+			_, _ = w.Write([]byte(strings.Repeat("x", 2048)))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Method", r.Method)
+		_, _ = w.Write([]byte(r.Header.Get("X-Greeting") + string(body)))
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	test.Nil(t, err)
+
+	runtime := wasm.NewInterpreterRuntime()
+	defer func() {
+		err := runtime.Close(ctx)
+		test.Nil(t, err)
+	}()
+	var recs []*wasm.Recording
+	m, err := wasm.NewModule(ctx, runtime, fetchw, "event", log,
+		wasm.WithRecorder(func(_ context.Context, r *wasm.Recording) error {
+			recs = append(recs, r)
+			return nil
+		}),
+		wasm.WithHTTPFetch(&wasm.HTTPFetchConfig{
+			Allow: []wasm.AllowedHost{
+				{Host: u.Host, Methods: []string{http.MethodGet, http.MethodPost}},
+				{Host: "readonly.local"},
+			},
+			MaxRequestBytes:  256,
+			MaxResponseBytes: 1024,
+			Timeout:          50 * time.Millisecond,
+		}))
+	test.Nil(t, err)
+	defer m.Close(ctx)
+
+	request := func(r wasm.FetchRequest) string {
+		b, err := json.Marshal(r)
+		test.Nil(t, err)
+		return string(b)
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		errno, res, err := m.Run(ctx, request(wasm.FetchRequest{
+			Method:  http.MethodPost,
+			URL:     srv.URL + "/echo",
+			Headers: map[string]string{"X-Greeting": "hello"},
+			Body:    []byte(" world"),
+		}))
+		test.Nil(t, err)
+		test.Equals(t, errno, uint64(wasm.FetchOK))
+		var r wasm.FetchResponse
+		err = json.Unmarshal([]byte(res), &r)
+		test.Nil(t, err)
+		test.Equals(t, r.Status, http.StatusOK)
+		test.Equals(t, string(r.Body), "hello world")
+		test.Equals(t, r.Headers["X-Method"], http.MethodPost)
+	})
+	t.Run("replay", func(t *testing.T) {
+		test.NotNil(t, recs)
+		err := wasm.Replay(ctx, runtime, fetchw, recs[0])
+		test.Nil(t, err)
+	})
+	t.Run("redirect", func(t *testing.T) {
+		errno, res, err := m.Run(ctx, request(wasm.FetchRequest{
+			URL:     srv.URL + "/redirect?to=" + url.QueryEscape(srv.URL+"/echo"),
+			Headers: map[string]string{"X-Greeting": "redirected"},
+		}))
+		test.Nil(t, err)
+		test.Equals(t, errno, uint64(wasm.FetchOK))
+		var r wasm.FetchResponse
+		err = json.Unmarshal([]byte(res), &r)
+		test.Nil(t, err)
+		test.Equals(t, string(r.Body), "redirected")
+	})
+	cases := []struct {
+		name  string
+		req   string
+		errno uint32
+	}{
+		{"denied_method", request(wasm.FetchRequest{Method: http.MethodDelete, URL: srv.URL}), wasm.FetchDenied},
+		{"denied_host", request(wasm.FetchRequest{URL: "http://other.local/"}), wasm.FetchDenied},
+		{"default_methods", request(wasm.FetchRequest{Method: http.MethodPost, URL: "http://readonly.local/"}), wasm.FetchDenied},
+		{"invalid_request", "{", wasm.FetchInvalid},
+		{"invalid_scheme", request(wasm.FetchRequest{URL: "file:///etc/passwd"}), wasm.FetchInvalid},
+		{"request_too_large", request(wasm.FetchRequest{URL: srv.URL, Body: []byte(strings.Repeat("x", 256))}), wasm.FetchTooLarge},
+		{"response_too_large", request(wasm.FetchRequest{URL: srv.URL + "/large"}), wasm.FetchTooLarge},
+		{"denied_redirect", request(wasm.FetchRequest{URL: srv.URL + "/redirect?to=" + url.QueryEscape(other.URL)}), wasm.FetchDenied},
+		{"timeout", request(wasm.FetchRequest{URL: srv.URL + "/slow"}), wasm.FetchTimeout},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			errno, _, err := m.Run(ctx, c.req)
+			test.Nil(t, err)
+			test.Equals(t, errno, uint64(c.errno))
+		})
+	}
+}
+
+func TestHTTPFetchDisabled(t *testing.T) {
+	ctx := context.Background()
+	runtime := wasm.NewInterpreterRuntime()
+	defer func() {
+		err := runtime.Close(ctx)
+		test.Nil(t, err)
+	}()
+	_, err := wasm.NewModule(ctx, runtime, fetchw, "event", log)
+	test.NotNil(t, err)
+}
+
+func TestHTTPFetchTimeout(t *testing.T) {
+	ctx := context.Background()
+	// longer than the timeout of the default client
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(1200 * time.Millisecond)
+		_, _ = w.Write([]byte("slow"))
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	test.Nil(t, err)
+	runtime := wasm.NewInterpreterRuntime()
+	defer func() {
+		err := runtime.Close(ctx)
+		test.Nil(t, err)
+	}()
+	m, err := wasm.NewModule(ctx, runtime, fetchw, "event", log,
+		wasm.WithHTTPFetch(&wasm.HTTPFetchConfig{
+			Allow:   []wasm.AllowedHost{{Host: u.Host}},
+			Timeout: 5 * time.Second,
+		}))
+	test.Nil(t, err)
+	defer m.Close(ctx)
+	b, err := json.Marshal(wasm.FetchRequest{URL: srv.URL})
+	test.Nil(t, err)
+	errno, _, err := m.Run(ctx, string(b))
+	test.Nil(t, err)
+	test.Equals(t, errno, uint64(wasm.FetchOK))
+}
+
+// dialer connects the clients to addr, whatever the host of the URL.
+type dialer struct {
+	addr string
+}
+
+func (d dialer) NewHTTPClient(_ string) (*http.Client, error) {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var nd net.Dialer
+			return nd.DialContext(ctx, network, d.addr)
+		},
+	}}, nil
+}
+
+func TestHTTPFetchPorts(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	test.Nil(t, err)
+	runtime := wasm.NewInterpreterRuntime()
+	defer func() {
+		err := runtime.Close(ctx)
+		test.Nil(t, err)
+	}()
+	m, err := wasm.NewModule(ctx, runtime, fetchw, "event", log,
+		wasm.WithHTTPFetch(&wasm.HTTPFetchConfig{
+			Client: dialer{addr: u.Host},
+			Allow: []wasm.AllowedHost{
+				{Host: "api.example.com"},
+				{Host: "API.example.org:80"},
+				{Host: "[::1]"},
+			},
+		}))
+	test.Nil(t, err)
+	defer m.Close(ctx)
+	cases := []struct {
+		url   string
+		errno uint32
+	}{
+		{"http://api.example.com/", wasm.FetchOK},
+		{"http://api.example.com:80/", wasm.FetchOK},
+		{"http://api.example.org/", wasm.FetchOK},
+		{"http://[::1]:80/", wasm.FetchOK},
+		{"http://api.example.com:8080/", wasm.FetchDenied},
+		{"https://api.example.org/", wasm.FetchDenied},
+	}
+	for _, c := range cases {
+		t.Run(c.url, func(t *testing.T) {
+			b, err := json.Marshal(wasm.FetchRequest{URL: c.url})
+			test.Nil(t, err)
+			errno, _, err := m.Run(ctx, string(b))
+			test.Nil(t, err)
+			test.Equals(t, errno, uint64(c.errno))
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+var ErrInvalidModule = errors.New("invalid wasm module")
+
+// ModuleInfo describes a compiled module without instantiating it.
+type ModuleInfo struct {
+	Name           string
+	Imports        []FunctionInfo
+	Exports        []FunctionInfo
+	Memory         *MemoryInfo
+	ABI            ModuleType
+	Mode           ExecMode
+	CustomSections []CustomSection
+}
+
+type FunctionInfo struct {
+	Module  string
+	Name    string
+	Params  []api.ValueType
+	Results []api.ValueType
+}
+
+type MemoryInfo struct {
+	Name     string
+	Imported bool
+	Min      uint32
+	Max      uint32
+	HasMax   bool
+}
+
+type CustomSection struct {
+	Name string
+	Data []byte
+}
+
+// Inspect compiles the module and reports its imports, exports, memory
+// limits, detected ABI and custom sections.
+func Inspect(wasmModule []byte) (*ModuleInfo, error) {
+	ctx := context.Background()
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfigInterpreter().WithCustomSections(true))
+	defer r.Close(ctx)
+	compiled, err := r.CompileModule(ctx, wasmModule)
+	if err != nil {
+		return nil, errors.Join(ErrInvalidModule, err)
+	}
+	return newModuleInfo(compiled), nil
+}
+
+func newModuleInfo(compiled wazero.CompiledModule) *ModuleInfo {
+	info := &ModuleInfo{
+		Name: compiled.Name(),
+	}
+	for _, d := range compiled.ImportedFunctions() {
+		module, name, _ := d.Import()
+		info.Imports = append(info.Imports, newFunctionInfo(module, name, d))
+	}
+	for name, d := range compiled.ExportedFunctions() {
+		info.Exports = append(info.Exports, newFunctionInfo("", name, d))
+	}
+	sort.Slice(info.Exports, func(i, j int) bool { return info.Exports[i].Name < info.Exports[j].Name })
+	for _, m := range compiled.ImportedMemories() {
+		_, name, _ := m.Import()
+		info.Memory = newMemoryInfo(name, true, m)
+	}
+	for name, m := range compiled.ExportedMemories() {
+		info.Memory = newMemoryInfo(name, false, m)
+	}
+	for _, c := range compiled.CustomSections() {
+		info.CustomSections = append(info.CustomSections, CustomSection{Name: c.Name(), Data: c.Data()})
+	}
+	if free := info.Export("free"); free != nil && len(free.Params) == 2 {
+		info.ABI = TypeRust
+	}
+	if info.Export("malloc") == nil && info.Export("_start") != nil {
+		info.Mode = ModeCommand
+	}
+	return info
+}
+
+func newFunctionInfo(module, name string, d api.FunctionDefinition) FunctionInfo {
+	return FunctionInfo{
+		Module:  module,
+		Name:    name,
+		Params:  d.ParamTypes(),
+		Results: d.ResultTypes(),
+	}
+}
+
+func newMemoryInfo(name string, imported bool, m api.MemoryDefinition) *MemoryInfo {
+	maxPages, hasMax := m.Max()
+	return &MemoryInfo{
+		Name:     name,
+		Imported: imported,
+		Min:      m.Min(),
+		Max:      maxPages,
+		HasMax:   hasMax,
+	}
+}
+
+// Export returns the exported function with the given name or nil.
+func (m *ModuleInfo) Export(name string) *FunctionInfo {
+	for i := range m.Exports {
+		if m.Exports[i].Name == name {
+			return &m.Exports[i]
+		}
+	}
+	return nil
+}
+
+// Validate checks that the module implements the exports required by the
+// execution mode. The returned error wraps ErrInvalidModule and describes
+// every problem found.
+func (m *ModuleInfo) Validate(mode ExecMode, mainFuncName string) error {
+	i32 := api.ValueTypeI32
+	var errs []error
+	check := func(name string, results []api.ValueType, params ...[]api.ValueType) {
+		f := m.Export(name)
+		if f == nil {
+			errs = append(errs, fmt.Errorf("%w: missing export %q", ErrInvalidModule, name))
+			return
+		}
+		if !slices.Equal(f.Results, results) || !slices.ContainsFunc(params, func(p []api.ValueType) bool {
+			return slices.Equal(f.Params, p)
+		}) {
+			errs = append(errs, fmt.Errorf("%w: export %q has signature %s, expected %s", ErrInvalidModule,
+				name, signature(f.Params, f.Results), signature(params[0], results)))
+		}
+	}
+	if mode == ModeCommand {
+		check("_start", nil, nil)
+		return errors.Join(errs...)
+	}
+	check("init", nil, nil)
+	check("malloc", []api.ValueType{i32}, []api.ValueType{i32})
+	check("free", nil, []api.ValueType{i32}, []api.ValueType{i32, i32})
+	check(mainFuncName, nil, []api.ValueType{i32, i32, i32})
+	if m.Memory == nil {
+		errs = append(errs, fmt.Errorf("%w: missing memory", ErrInvalidModule))
+	}
+	return errors.Join(errs...)
+}
+
+func (f FunctionInfo) String() string {
+	n := f.Name
+	if f.Module != "" {
+		n = f.Module + "." + n
+	}
+	return n + signature(f.Params, f.Results)
+}
+
+func signature(params, results []api.ValueType) string {
+	names := func(vt []api.ValueType) string {
+		s := make([]string, len(vt))
+		for i, v := range vt {
+			s[i] = api.ValueTypeName(v)
+		}
+		return strings.Join(s, ",")
+	}
+	return "(" + names(params) + ")->(" + names(results) + ")"
+}
@@ -0,0 +1,361 @@
+package wasm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrescosta/goico/pkg/database"
+	"github.com/rs/zerolog"
+)
+
+var (
+	ErrModuleNotFound = errors.New("module not found")
+	ErrNoPrevious     = errors.New("no previous version to roll back to")
+)
+
+// ModuleBlob is a named version of a module.
+type ModuleBlob struct {
+	Name    string
+	Version string
+	Wasm    []byte
+	// Signature is the detached signature of the module, if any.
+	Signature []byte
+}
+
+// Source lists the latest version of every module the Manager serves.
+type Source interface {
+	Modules(ctx context.Context) ([]ModuleBlob, error)
+}
+
+// DirSource serves the *.wasm files of a directory. The module name is the
+// file name without extension. The detached signature of a module is read
+// from the file with the .wasm.sig extension.
+type DirSource struct {
+	Dir string
+}
+
+// TableSource serves the modules stored in a database table.
+type TableSource struct {
+	Table *database.Table[ModuleBlob]
+}
+
+type ManagerOption func(*Manager)
+
+// Manager serves the modules of a Source and swaps in new versions without
+// interrupting the calls in flight. The previous version of every module is
+// kept for rollback.
+type Manager struct {
+	runtime      *Runtime
+	source       Source
+	mainFuncName string
+	logFn        LogFn
+	poolSize     int
+	interval     time.Duration
+	moduleOpts   []ModuleOption
+	mu           sync.RWMutex
+	reloadMu     sync.Mutex
+	modules      map[string]*managedModule
+	worker       sync.WaitGroup
+	retired      sync.WaitGroup
+	cancel       context.CancelFunc
+}
+
+type managedModule struct {
+	current  *moduleVersion
+	previous *moduleVersion
+	// rolledBack is the version replaced by Rollback. It is not loaded again
+	// until the source publishes a different one.
+	rolledBack string
+}
+
+type moduleVersion struct {
+	version  string
+	pool     *Pool
+	inflight sync.WaitGroup
+}
+
+func NewManager(runtime *Runtime, source Source, mainFuncName string, logExt LogFn, opts ...ManagerOption) *Manager {
+	m := &Manager{
+		runtime:      runtime,
+		source:       source,
+		mainFuncName: mainFuncName,
+		logFn:        logExt,
+		poolSize:     1,
+		interval:     5 * time.Second,
+		modules:      make(map[string]*managedModule),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Start loads the modules and keeps polling the source in background until
+// Close is called or ctx is done. It fails only when the source cannot be
+// read; the modules that fail to compile are logged and loaded by the next
+// poll that finds a valid version.
+func (m *Manager) Start(ctx context.Context) error {
+	m.reloadMu.Lock()
+	blobs, err := m.source.Modules(ctx)
+	if err == nil {
+		// the errors of every module are logged by load
+		_ = m.load(ctx, blobs)
+	}
+	m.reloadMu.Unlock()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	m.cancel = cancel
+	m.worker.Add(1)
+	go func() {
+		defer m.worker.Done()
+		logger := zerolog.Ctx(ctx)
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := m.Reload(ctx); err != nil {
+					logger.Warn().AnErr("err", err).Msg("Manager: error reloading modules")
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Reload compiles the modules whose version changed and swaps them in.
+// Modules that fail to compile keep serving their current version, and the
+// modules no longer in the source are retired.
+func (m *Manager) Reload(ctx context.Context) error {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+	blobs, err := m.source.Modules(ctx)
+	if err != nil {
+		return err
+	}
+	return m.load(ctx, blobs)
+}
+
+// load swaps in the blobs with a new version and removes the modules not in
+// blobs. It returns the errors of the modules that failed to compile. It
+// must be called with reloadMu held.
+func (m *Manager) load(ctx context.Context, blobs []ModuleBlob) error {
+	logger := zerolog.Ctx(ctx)
+	m.remove(ctx, blobs)
+	var errs error
+	for _, b := range blobs {
+		if b.Version == "" {
+			b.Version = Hash(b.Wasm)
+		}
+		if !m.isNewVersion(b.Name, b.Version) {
+			continue
+		}
+		opts := append([]ModuleOption{WithName(b.Name), WithVersion(b.Version)}, m.moduleOpts...)
+		if b.Signature != nil {
+			opts = append(opts, WithSignature(b.Signature))
+		}
+		pool, err := NewPool(ctx, m.runtime, b.Wasm, m.mainFuncName, m.logFn, m.poolSize, opts...)
+		if err != nil {
+			errs = errors.Join(errs, err)
+			logger.Warn().AnErr("err", err).Str("module", b.Name).Str("version", b.Version).Msg("Manager: error compiling module")
+			continue
+		}
+		m.swap(ctx, b.Name, &moduleVersion{version: b.Version, pool: pool})
+		logger.Debug().Str("module", b.Name).Str("version", b.Version).Msg("Manager: new version loaded")
+	}
+	return errs
+}
+
+// remove retires the modules that are not in blobs.
+func (m *Manager) remove(ctx context.Context, blobs []ModuleBlob) {
+	names := make(map[string]bool, len(blobs))
+	for _, b := range blobs {
+		names[b.Name] = true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, mm := range m.modules {
+		if names[name] {
+			continue
+		}
+		m.retire(ctx, mm.current)
+		if mm.previous != nil {
+			m.retire(ctx, mm.previous)
+		}
+		delete(m.modules, name)
+		zerolog.Ctx(ctx).Debug().Str("module", name).Msg("Manager: module removed")
+	}
+}
+
+func (m *Manager) isNewVersion(name, version string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	mm, ok := m.modules[name]
+	if !ok {
+		return true
+	}
+	return mm.current.version != version && mm.rolledBack != version
+}
+
+func (m *Manager) swap(ctx context.Context, name string, v *moduleVersion) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mm, ok := m.modules[name]
+	if !ok {
+		m.modules[name] = &managedModule{current: v}
+		return
+	}
+	if mm.previous != nil {
+		m.retire(ctx, mm.previous)
+	}
+	mm.previous = mm.current
+	mm.current = v
+	mm.rolledBack = ""
+}
+
+// retire closes the version once the calls in flight end. It must be called
+// with the lock held, so no new call can reach the version.
+func (m *Manager) retire(ctx context.Context, v *moduleVersion) {
+	m.retired.Add(1)
+	go func() {
+		defer m.retired.Done()
+		v.inflight.Wait()
+		if err := v.pool.Close(ctx); err != nil {
+			zerolog.Ctx(ctx).Warn().AnErr("err", err).Str("version", v.version).Msg("Manager: error closing version")
+		}
+	}()
+}
+
+// Run executes the current version of the module.
+func (m *Manager) Run(ctx context.Context, name string, data string) (uint64, string, error) {
+	m.mu.RLock()
+	mm, ok := m.modules[name]
+	if !ok {
+		m.mu.RUnlock()
+		return 0, "", ErrModuleNotFound
+	}
+	v := mm.current
+	v.inflight.Add(1)
+	m.mu.RUnlock()
+	defer v.inflight.Done()
+	return v.pool.Run(ctx, data)
+}
+
+// Rollback makes the previous version of the module the current one.
+func (m *Manager) Rollback(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mm, ok := m.modules[name]
+	if !ok {
+		return ErrModuleNotFound
+	}
+	if mm.previous == nil {
+		return ErrNoPrevious
+	}
+	mm.rolledBack = mm.current.version
+	mm.current, mm.previous = mm.previous, mm.current
+	return nil
+}
+
+// Version returns the current and previous version of the module.
+func (m *Manager) Version(name string) (string, string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	mm, ok := m.modules[name]
+	if !ok {
+		return "", ""
+	}
+	if mm.previous == nil {
+		return mm.current.version, ""
+	}
+	return mm.current.version, mm.previous.version
+}
+
+func (m *Manager) Close(ctx context.Context) error {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.worker.Wait()
+	m.mu.Lock()
+	for name, mm := range m.modules {
+		m.retire(ctx, mm.current)
+		if mm.previous != nil {
+			m.retire(ctx, mm.previous)
+		}
+		delete(m.modules, name)
+	}
+	m.mu.Unlock()
+	m.retired.Wait()
+	return nil
+}
+
+// Hash returns the hex encoded SHA-256 of the module.
+func Hash(wasmModule []byte) string {
+	h := sha256.Sum256(wasmModule)
+	return hex.EncodeToString(h[:])
+}
+
+func (d *DirSource) Modules(_ context.Context) ([]ModuleBlob, error) {
+	entries, err := os.ReadDir(d.Dir)
+	if err != nil {
+		return nil, err
+	}
+	blobs := make([]ModuleBlob, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".wasm" {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(d.Dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		sig, err := os.ReadFile(filepath.Join(d.Dir, e.Name()+".sig"))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		blobs = append(blobs, ModuleBlob{
+			Name:      strings.TrimSuffix(e.Name(), ".wasm"),
+			Wasm:      b,
+			Signature: sig,
+		})
+	}
+	return blobs, nil
+}
+
+func (t *TableSource) Modules(_ context.Context) ([]ModuleBlob, error) {
+	return t.Table.All()
+}
+
+func (b ModuleBlob) ID() string {
+	return b.Name
+}
+
+// Setters
+func WithPoolSize(size int) ManagerOption {
+	return func(m *Manager) {
+		m.poolSize = size
+	}
+}
+
+func WithPollInterval(interval time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.interval = interval
+	}
+}
+
+func WithModuleOptions(opts ...ModuleOption) ManagerOption {
+	return func(m *Manager) {
+		m.moduleOpts = opts
+	}
+}
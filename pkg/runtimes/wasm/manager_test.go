@@ -0,0 +1,178 @@
+package wasm_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/andrescosta/goico/pkg/database"
+	"github.com/andrescosta/goico/pkg/runtimes/wasm"
+	"github.com/andrescosta/goico/pkg/test"
+)
+
+func TestPool(t *testing.T) {
+	ctx := context.Background()
+	runtime := wasm.NewInterpreterRuntime()
+	defer func() {
+		err := runtime.Close(ctx)
+		test.Nil(t, err)
+	}()
+	pool, err := wasm.NewPool(ctx, runtime, echo, "event", log, 3)
+	test.Nil(t, err)
+	var w sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		w.Add(1)
+		go func() {
+			defer w.Done()
+			code, res, err := pool.Run(ctx, "pool")
+			if err != nil {
+				t.Errorf("not expected error: %v", err)
+				return
+			}
+			if code != 0 || res != "pool" {
+				t.Errorf("expected 0 pool got %d %s", code, res)
+			}
+		}()
+	}
+	w.Wait()
+	err = pool.Close(ctx)
+	test.Nil(t, err)
+	_, _, err = pool.Run(ctx, "pool")
+	test.ErrorIs(t, err, wasm.ErrPoolClosed)
+}
+
+func TestManagerDir(t *testing.T) {
+	ctx := context.Background()
+	runtime := wasm.NewInterpreterRuntime()
+	defer func() {
+		err := runtime.Close(ctx)
+		test.Nil(t, err)
+	}()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "jobicolet.wasm")
+	err := os.WriteFile(file, echo, 0o600)
+	test.Nil(t, err)
+	// a module that does not compile does not prevent the start
+	broken := filepath.Join(dir, "broken.wasm")
+	err = os.WriteFile(broken, []byte("invalid"), 0o600)
+	test.Nil(t, err)
+	m := wasm.NewManager(runtime, &wasm.DirSource{Dir: dir}, "event", log, wasm.WithPoolSize(2))
+	err = m.Start(ctx)
+	test.Nil(t, err)
+	_, _, err = m.Run(ctx, "broken", "")
+	test.ErrorIs(t, err, wasm.ErrModuleNotFound)
+	err = os.Remove(broken)
+	test.Nil(t, err)
+	defer func() {
+		err := m.Close(ctx)
+		test.Nil(t, err)
+	}()
+	expect := func(code uint64) {
+		t.Helper()
+		c, res, err := m.Run(ctx, "jobicolet", "test_error")
+		test.Nil(t, err)
+		if c != code || res != "test_error" {
+			t.Errorf("expected %d test_error got %d %s", code, c, res)
+		}
+	}
+	expect(0)
+	current, previous := m.Version("jobicolet")
+	if current != wasm.Hash(echo) || previous != "" {
+		t.Errorf("expected echo version got %s %s", current, previous)
+	}
+
+	// new version while calls are in flight
+	var w sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		w.Add(1)
+		go func() {
+			defer w.Done()
+			_, _, err := m.Run(ctx, "jobicolet", "test_error")
+			if err != nil {
+				t.Errorf("not expected error: %v", err)
+			}
+		}()
+	}
+	err = os.WriteFile(file, doerror, 0o600)
+	test.Nil(t, err)
+	err = m.Reload(ctx)
+	test.Nil(t, err)
+	w.Wait()
+	expect(500)
+	current, previous = m.Version("jobicolet")
+	if current != wasm.Hash(doerror) || previous != wasm.Hash(echo) {
+		t.Errorf("expected error and echo versions got %s %s", current, previous)
+	}
+
+	// rollback is kept until the source changes
+	err = m.Rollback("jobicolet")
+	test.Nil(t, err)
+	err = m.Reload(ctx)
+	test.Nil(t, err)
+	expect(0)
+
+	// invalid versions do not replace the current one
+	err = os.WriteFile(file, []byte("invalid"), 0o600)
+	test.Nil(t, err)
+	err = m.Reload(ctx)
+	test.ErrorIs(t, err, wasm.ErrInvalidModule)
+	expect(0)
+
+	_, _, err = m.Run(ctx, "unknown", "")
+	test.ErrorIs(t, err, wasm.ErrModuleNotFound)
+	err = m.Rollback("unknown")
+	test.ErrorIs(t, err, wasm.ErrModuleNotFound)
+
+	// modules removed from the source are retired
+	err = os.Remove(file)
+	test.Nil(t, err)
+	err = m.Reload(ctx)
+	test.Nil(t, err)
+	_, _, err = m.Run(ctx, "jobicolet", "test_error")
+	test.ErrorIs(t, err, wasm.ErrModuleNotFound)
+	current, previous = m.Version("jobicolet")
+	test.Equals(t, current, "")
+	test.Equals(t, previous, "")
+}
+
+func TestManagerTable(t *testing.T) {
+	ctx := context.Background()
+	runtime := wasm.NewInterpreterRuntime()
+	defer func() {
+		err := runtime.Close(ctx)
+		test.Nil(t, err)
+	}()
+	db, err := database.Open(ctx, filepath.Join(t.TempDir(), "db"), database.Option{InMemory: true})
+	test.Nil(t, err)
+	defer func() {
+		err := db.Close()
+		test.Nil(t, err)
+	}()
+	table := database.NewTable(db, "modules", "tenant", database.BinaryMarshaller[wasm.ModuleBlob]{})
+	err = table.Add(wasm.ModuleBlob{Name: "jobicolet", Version: "v1", Wasm: echo})
+	test.Nil(t, err)
+	m := wasm.NewManager(runtime, &wasm.TableSource{Table: table}, "event", log)
+	err = m.Reload(ctx)
+	test.Nil(t, err)
+	defer func() {
+		err := m.Close(ctx)
+		test.Nil(t, err)
+	}()
+	err = m.Rollback("jobicolet")
+	test.ErrorIs(t, err, wasm.ErrNoPrevious)
+	err = table.Update(wasm.ModuleBlob{Name: "jobicolet", Version: "v2", Wasm: doerror})
+	test.Nil(t, err)
+	err = m.Reload(ctx)
+	test.Nil(t, err)
+	current, previous := m.Version("jobicolet")
+	if current != "v2" || previous != "v1" {
+		t.Errorf("expected v2 v1 got %s %s", current, previous)
+	}
+	code, _, err := m.Run(ctx, "jobicolet", "test")
+	test.Nil(t, err)
+	if code != 500 {
+		t.Errorf("expected 500 got %d", code)
+	}
+}
@@ -0,0 +1,122 @@
+package wasm
+
+import (
+	"context"
+	"errors"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// ErrNoInstance is returned by Run when recycling the instance failed.
+var ErrNoInstance = errors.New("module has no instance")
+
+// Reasons to recycle an instance.
+const (
+	recycleMaxPages     = "max_pages"
+	recycleMaxGrowth    = "max_growth"
+	recycleLeakedAllocs = "leaked_allocations"
+)
+
+// MemoryLimits recycle the instance of a reactor module when its memory
+// grows, which usually means the guest leaks memory. Zero values disable the
+// limit.
+type MemoryLimits struct {
+	// MaxPages is the maximum number of memory pages after a call.
+	MaxPages uint32
+	// MaxGrowth is the maximum number of pages the memory can grow since the
+	// instance was created.
+	MaxGrowth uint32
+	// MaxLeakedAllocs is the maximum number of allocations made by the host
+	// that the guest did not free.
+	MaxLeakedAllocs int
+}
+
+// MemoryStats describe the memory of the current instance of a module.
+type MemoryStats struct {
+	// Pages is the size of the memory after the last call.
+	Pages uint32
+	// BasePages is the size of the memory when the instance was created.
+	BasePages uint32
+	// Calls is the number of calls since the instance was created.
+	Calls int64
+	// LeakedAllocs is the number of allocations of the host not freed.
+	LeakedAllocs int
+	// Recycles is the number of times the instance was recycled.
+	Recycles int64
+}
+
+// LeakRate returns the pages the memory grew per call since the instance was
+// created.
+func (m MemoryStats) LeakRate() float64 {
+	if m.Calls == 0 {
+		return 0
+	}
+	return float64(m.Pages-m.BasePages) / float64(m.Calls)
+}
+
+// MemoryStats returns the memory stats of the current instance. Command
+// modules do not keep an instance and return zero stats.
+func (f *Module) MemoryStats() MemoryStats {
+	s := f.memory
+	s.LeakedAllocs = len(f.allocs)
+	return s
+}
+
+func (f *Module) resetMemoryStats() {
+	pages := f.module.Memory().Size() / pageSize
+	f.allocs = make(map[uint64]uint64)
+	f.memory = MemoryStats{
+		Pages:     pages,
+		BasePages: pages,
+		Recycles:  f.memory.Recycles,
+	}
+}
+
+// checkMemory measures the memory after a call and recycles the instance when
+// it crossed the limits.
+func (f *Module) checkMemory(ctx context.Context) {
+	attrs := metric.WithAttributes(f.attributes()...)
+	pages := f.module.Memory().Size() / pageSize
+	f.telemetry.memoryGrowth.Record(ctx, int64(pages-f.memory.Pages), attrs)
+	f.memory.Pages = pages
+	f.memory.Calls++
+	stats := f.MemoryStats()
+	limits := f.config.MemoryLimits
+	var reason string
+	switch {
+	case limits.MaxLeakedAllocs > 0 && stats.LeakedAllocs > limits.MaxLeakedAllocs:
+		reason = recycleLeakedAllocs
+	case limits.MaxPages > 0 && pages > limits.MaxPages:
+		reason = recycleMaxPages
+	case limits.MaxGrowth > 0 && pages-stats.BasePages > limits.MaxGrowth:
+		reason = recycleMaxGrowth
+	default:
+		return
+	}
+	zerolog.Ctx(ctx).Warn().
+		Str("module", f.config.Name).
+		Str("version", f.config.Version).
+		Str("reason", reason).
+		Uint32("pages", pages).
+		Uint32("base_pages", stats.BasePages).
+		Int64("calls", stats.Calls).
+		Float64("leak_rate", stats.LeakRate()).
+		Int("leaked_allocs", stats.LeakedAllocs).
+		Msg("recycling module instance")
+	f.telemetry.recycles.Add(ctx, 1, attrs, metric.WithAttributes(attribute.String("wasm.recycle.reason", reason)))
+	if err := f.recycle(ctx); err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("module", f.config.Name).Msg("error recycling module instance")
+	}
+}
+
+// recycle replaces the instance with a new one.
+func (f *Module) recycle(ctx context.Context) error {
+	if err := f.module.Close(ctx); err != nil {
+		return err
+	}
+	f.module = nil
+	f.memory.Recycles++
+	return f.instantiate(ctx)
+}
@@ -0,0 +1,90 @@
+package wasm_test
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"strings"
+	"testing"
+
+	"github.com/andrescosta/goico/pkg/runtimes/wasm"
+	"github.com/andrescosta/goico/pkg/test"
+	"github.com/rs/zerolog"
+)
+
+//go:embed testdata/leak.wasm
+var leak []byte
+
+func TestMemoryLimits(t *testing.T) {
+	ctx := context.Background()
+	runtime := wasm.NewInterpreterRuntime()
+	defer runtime.Close(ctx)
+
+	t.Run("growth", func(t *testing.T) {
+		var out bytes.Buffer
+		ctx := zerolog.New(&out).WithContext(ctx)
+		m, err := wasm.NewModule(ctx, runtime, leak, "event", log,
+			wasm.WithName("leaky"), wasm.WithMemoryLimits(wasm.MemoryLimits{MaxGrowth: 3}))
+		test.Nil(t, err)
+		defer m.Close(ctx)
+		base := m.MemoryStats().BasePages
+		var res string
+		for i := 0; i < 2; i++ {
+			_, res, err = m.Run(ctx, "in")
+			test.Nil(t, err)
+			test.Equals(t, res, "in")
+		}
+		s := m.MemoryStats()
+		test.Equals(t, s.Calls, int64(2))
+		test.Equals(t, s.LeakedAllocs, 0)
+		if s.LeakRate() <= 0 {
+			t.Errorf("expected a leak rate got %f", s.LeakRate())
+		}
+		for i := 0; i < 10; i++ {
+			_, _, err := m.Run(ctx, "in")
+			test.Nil(t, err)
+			if s := m.MemoryStats(); s.Pages-s.BasePages > 3 {
+				t.Fatalf("expected at most 3 pages of growth got %d", s.Pages-s.BasePages)
+			}
+		}
+		s = m.MemoryStats()
+		if s.Recycles == 0 {
+			t.Errorf("expected the instance to be recycled")
+		}
+		test.Equals(t, s.BasePages, base)
+		if !strings.Contains(out.String(), `"reason":"max_growth"`) {
+			t.Errorf("expected recycle log got %s", out.String())
+		}
+		_, res, err = m.Run(ctx, "after")
+		test.Nil(t, err)
+		test.Equals(t, res, "after")
+	})
+	t.Run("max_pages", func(t *testing.T) {
+		m, err := wasm.NewModule(ctx, runtime, leak, "event", log,
+			wasm.WithMemoryLimits(wasm.MemoryLimits{MaxPages: 4}))
+		test.Nil(t, err)
+		defer m.Close(ctx)
+		for i := 0; i < 10; i++ {
+			_, _, err := m.Run(ctx, "in")
+			test.Nil(t, err)
+			if m.MemoryStats().Pages > 4 {
+				t.Fatalf("expected at most 4 pages got %d", m.MemoryStats().Pages)
+			}
+		}
+		if m.MemoryStats().Recycles == 0 {
+			t.Errorf("expected the instance to be recycled")
+		}
+	})
+	t.Run("no_limits", func(t *testing.T) {
+		m, err := wasm.NewModule(ctx, runtime, echo, "event", log)
+		test.Nil(t, err)
+		defer m.Close(ctx)
+		for i := 0; i < 3; i++ {
+			_, _, err := m.Run(ctx, "in")
+			test.Nil(t, err)
+		}
+		s := m.MemoryStats()
+		test.Equals(t, s.Recycles, int64(0))
+		test.Equals(t, s.LeakedAllocs, 0)
+	})
+}
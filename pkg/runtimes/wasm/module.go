@@ -4,21 +4,32 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"strings"
+	"time"
 	"unsafe"
 
 	"github.com/rs/zerolog"
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
 	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
 )
 
 type (
 	ModuleType uint32
+	ExecMode   uint32
 	LogFn      func(context.Context, uint32, string) error
 )
 
 type Module struct {
+	runtime    wazero.Runtime
+	compiled   wazero.CompiledModule
+	config     *ModuleConfig
+	telemetry  *telemetry
 	mainFunc   api.Function
 	initFunc   api.Function
 	mallocFunc api.Function
@@ -27,6 +38,15 @@ type Module struct {
 	freeFn     func(context.Context, uint64, uint64) ([]uint64, error)
 	module     api.Module
 	ver        ModuleType
+	// tape records the executions, or replays them.
+	tape         *tape
+	hash         string
+	mainFuncName string
+	// allocs are the allocations of the host not freed yet, by offset.
+	allocs map[uint64]uint64
+	memory MemoryStats
+	// secrets are the resolved secrets, by key.
+	secrets map[string]string
 }
 
 type EventFuncResult struct {
@@ -39,26 +59,93 @@ const (
 	TypeRust
 )
 
-func NewModule(ctx context.Context, runtime *Runtime, wasmModule []byte, mainFuncName string, logExt LogFn) (*Module, error) {
+const (
+	// ModeReactor runs modules that implement the init, malloc, free and main
+	// exports. The module is instantiated once and reused by every Run.
+	ModeReactor ExecMode = iota
+	// ModeCommand runs WASI command modules. Every Run instantiates the module,
+	// executes _start with the payload as stdin and returns stdout as result
+	// and the exit code as errno.
+	ModeCommand
+)
+
+func NewModule(ctx context.Context, runtime *Runtime, wasmModule []byte, mainFuncName string, logExt LogFn, opts ...ModuleOption) (*Module, error) {
+	config := newModuleConfig(opts)
+	if config.Verifier != nil {
+		if err := config.Verifier.Verify(ctx, config.Name, wasmModule, config.Signature); err != nil {
+			return nil, err
+		}
+	}
+	t, err := newTelemetry(config.OtelProvider)
+	if err != nil {
+		return nil, err
+	}
 	wm := &Module{
-		logFn: logExt,
+		logFn:        logExt,
+		config:       config,
+		telemetry:    t,
+		mainFuncName: mainFuncName,
+	}
+	switch {
+	case config.tape != nil:
+		wm.tape = config.tape
+	case config.Recorder != nil:
+		wm.tape = newTape(config)
+		wm.hash = Hash(wasmModule)
 	}
 
-	wazeroRuntime := wazero.NewRuntimeWithConfig(ctx, runtime.runtimeConfig)
+	runtimeConfig, err := runtime.config(wasmModule)
+	if err != nil {
+		return nil, err
+	}
+	wazeroRuntime := wazero.NewRuntimeWithConfig(ctx, runtimeConfig)
+	wm.runtime = wazeroRuntime
+
+	// the listeners are set when the modules are compiled
+	compileCtx := ctx
+	if config.Profiler != nil {
+		compileCtx = context.WithValue(ctx, experimental.FunctionListenerFactoryKey{}, config.Profiler)
+	}
 
 	// DON'T MOVE IT.
-	_, err := wazeroRuntime.NewHostModuleBuilder("env").
+	env := wazeroRuntime.NewHostModuleBuilder("env").
 		NewFunctionBuilder().WithFunc(wm.log).Export("log").
-		Instantiate(ctx)
+		NewFunctionBuilder().WithFunc(wm.emitHost).Export("emit").
+		NewFunctionBuilder().WithFunc(wm.configGet).Export("config_get")
+	if config.HTTPFetch != nil {
+		env = env.NewFunctionBuilder().WithFunc(wm.httpFetch).Export("http_fetch")
+	}
+	_, err = env.Instantiate(compileCtx)
 	if err != nil {
 		return nil, err
 	}
 
-	wasi_snapshot_preview1.MustInstantiate(ctx, wazeroRuntime)
-	module, err := wazeroRuntime.Instantiate(ctx, wasmModule)
+	wasi_snapshot_preview1.MustInstantiate(compileCtx, wazeroRuntime)
+	start := time.Now()
+	compiled, err := runtime.compile(compileCtx, wazeroRuntime, wasmModule)
 	if err != nil {
+		return nil, errors.Join(ErrInvalidModule, err)
+	}
+	wm.recordCompile(ctx, time.Since(start))
+	if err := newModuleInfo(compiled).Validate(config.Mode, mainFuncName); err != nil {
 		return nil, err
 	}
+	wm.compiled = compiled
+	if config.Mode == ModeCommand {
+		return wm, nil
+	}
+	if err := wm.instantiate(ctx); err != nil {
+		return nil, err
+	}
+	return wm, nil
+}
+
+// instantiate creates the instance of a reactor module and initializes it.
+func (f *Module) instantiate(ctx context.Context) error {
+	module, err := f.runtime.InstantiateModule(ctx, f.compiled, f.moduleConfig(ctx))
+	if err != nil {
+		return err
+	}
 	ver := TypeDefault
 	verFunc := module.ExportedFunction("ver")
 	if verFunc != nil {
@@ -68,31 +155,99 @@ func NewModule(ctx context.Context, runtime *Runtime, wasmModule []byte, mainFun
 		}
 	}
 	initf := module.ExportedFunction("init")
-	wm.mainFunc = module.ExportedFunction(mainFuncName)
-	wm.initFunc = initf
+	f.mainFunc = module.ExportedFunction(f.mainFuncName)
+	f.initFunc = initf
 	// for tinygo: tinygo-org/tinygo#2788
-	wm.mallocFunc = module.ExportedFunction("malloc")
-	wm.freeFunc = module.ExportedFunction("free")
-	wm.module = module
-	wm.ver = ver
+	f.mallocFunc = module.ExportedFunction("malloc")
+	f.freeFunc = module.ExportedFunction("free")
+	f.module = module
+	f.ver = ver
 
-	wm.freeFn = wm.free
+	f.freeFn = f.free
 	// Call the init function to initialize the module
 	_, err = call(ctx, initf)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return wm, nil
+	f.resetMemoryStats()
+	return nil
+}
+
+// malloc allocates memory in the guest for the host.
+func (f *Module) malloc(ctx context.Context, size uint64) (uint64, error) {
+	results, err := call(ctx, f.mallocFunc, size)
+	if err != nil {
+		return 0, err
+	}
+	f.allocs[results[0]] = size
+	return results[0], nil
+}
+
+// writeToGuest copies b to memory allocated with the malloc export of the
+// guest, and writes its pointer and length at offset as two little endian
+// uint32. The guest owns the memory.
+func writeToGuest(ctx context.Context, m api.Module, offset uint32, b []byte) error {
+	malloc := m.ExportedFunction("malloc")
+	if malloc == nil {
+		return errors.New("the guest does not export malloc")
+	}
+	results, err := malloc.Call(ctx, uint64(len(b)))
+	if err != nil {
+		return err
+	}
+	ptr := uint32(results[0])
+	if !m.Memory().Write(ptr, b) ||
+		!m.Memory().WriteUint32Le(offset, ptr) ||
+		!m.Memory().WriteUint32Le(offset+4, uint32(len(b))) {
+		return fmt.Errorf("Memory.Write(%d, %d) out of range", offset, len(b))
+	}
+	return nil
 }
 
 func (f *Module) free(ctx context.Context, offset, size uint64) ([]uint64, error) {
+	var res []uint64
+	var err error
 	if f.ver == TypeDefault {
-		return call(ctx, f.freeFunc, offset)
+		res, err = call(ctx, f.freeFunc, offset)
+	} else {
+		res, err = call(ctx, f.freeFunc, offset, size)
 	}
-	return call(ctx, f.freeFunc, offset, size)
+	if err == nil {
+		delete(f.allocs, offset)
+	}
+	return res, err
 }
 
 func (f *Module) Run(ctx context.Context, data string) (uint64, string, error) {
+	ctx, end := f.startRun(ctx, data)
+	recording := f.tape != nil && !f.tape.replay
+	var init []Event
+	if recording {
+		init = f.tape.start(nil)
+	}
+	errno, res, err := f.run(ctx, data)
+	if err != nil {
+		execErr := newExecError(err)
+		zerolog.Ctx(ctx).Warn().EmbedObject(execErr).Msg("error executing module")
+		err = execErr
+	}
+	end(errno, res, err)
+	if recording {
+		f.record(ctx, f.recording(init, data, errno, res, err))
+	}
+	if err == nil && f.module != nil {
+		f.checkMemory(ctx)
+	}
+	return errno, res, err
+}
+
+func (f *Module) run(ctx context.Context, data string) (uint64, string, error) {
+	if f.config.Mode == ModeCommand {
+		return f.runCommand(ctx, data)
+	}
+	if f.module == nil {
+		return 0, "", ErrNoInstance
+	}
 	logger := zerolog.Ctx(ctx)
 	// write to internal memory
 	strParamOffset, strParamSize, err := f.writeToMemory(ctx, data)
@@ -128,23 +283,51 @@ func (f *Module) Run(ctx context.Context, data string) (uint64, string, error) {
 	return errno, res, nil
 }
 
+func (f *Module) runCommand(ctx context.Context, data string) (uint64, string, error) {
+	var stdout bytes.Buffer
+	cfg := f.moduleConfig(ctx).
+		WithName("").
+		WithStdin(strings.NewReader(data))
+	if f.config.Stdout != nil {
+		cfg = cfg.WithStdout(io.MultiWriter(&stdout, f.config.Stdout))
+	} else {
+		cfg = cfg.WithStdout(&stdout)
+	}
+	zerolog.Ctx(ctx).Debug().Msg("calling _start")
+	module, err := f.runtime.InstantiateModule(ctx, f.compiled, cfg)
+	if err != nil {
+		var exitErr *sys.ExitError
+		if errors.As(err, &exitErr) && !isContextExit(exitErr) {
+			return uint64(exitErr.ExitCode()), stdout.String(), nil
+		}
+		return 0, "", err
+	}
+	if err := module.Close(ctx); err != nil {
+		return 0, "", err
+	}
+	return 0, stdout.String(), nil
+}
+
+func isContextExit(err *sys.ExitError) bool {
+	return err.ExitCode() == sys.ExitCodeContextCanceled ||
+		err.ExitCode() == sys.ExitCodeDeadlineExceeded
+}
+
 func (f *Module) reserveMemoryForResult(ctx context.Context) (uint64, uint64, error) {
 	eventDataSize := uint64(unsafe.Sizeof(EventFuncResult{}))
-	results, err := call(ctx, f.mallocFunc, eventDataSize)
+	eventDataPtr, err := f.malloc(ctx, eventDataSize)
 	if err != nil {
 		return 0, 0, err
 	}
-	eventDataPtr := results[0]
 	return eventDataPtr, eventDataSize, nil
 }
 
 func (f *Module) writeToMemory(ctx context.Context, data string) (uint64, uint64, error) {
 	size := uint64(len(data))
-	results, err := call(ctx, f.mallocFunc, size)
+	offset, err := f.malloc(ctx, size)
 	if err != nil {
 		return 0, 0, err
 	}
-	offset := results[0]
 	if !f.module.Memory().Write(uint32(offset), []byte(data)) {
 		return 0, 0, fmt.Errorf("Memory.Write(%d, %d) out of range of memory size %d",
 			offset, size, f.module.Memory().Size())
@@ -195,7 +378,11 @@ func (f *Module) log(ctx context.Context, m api.Module, level, offset, byteCount
 	if !ok {
 		logger.Error().Msgf("Memory.Read(%d, %d) out of range", offset, byteCount)
 	}
-	msg := string(buf)
+	msg := f.redact(string(buf))
+	if f.tape != nil {
+		f.tape.log(level, msg)
+	}
+	logEvent(ctx, level, msg)
 	logger.WithLevel(zerolog.Level(level)).Msg(msg)
 	if f.logFn != nil {
 		if err := f.logFn(ctx, level, msg); err != nil {
@@ -204,8 +391,21 @@ func (f *Module) log(ctx context.Context, m api.Module, level, offset, byteCount
 	}
 }
 
+func (f *Module) moduleConfig(ctx context.Context) wazero.ModuleConfig {
+	cfg := f.config.wazeroConfig(ctx)
+	if f.tape != nil {
+		cfg = f.tape.moduleConfig(cfg)
+	}
+	return cfg
+}
+
 func (f *Module) Close(ctx context.Context) error {
-	if err := f.module.Close(ctx); err != nil {
+	if f.module != nil {
+		if err := f.module.Close(ctx); err != nil {
+			return err
+		}
+	}
+	if err := f.runtime.Close(ctx); err != nil {
 		return err
 	}
 	return nil
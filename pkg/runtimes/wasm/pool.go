@@ -0,0 +1,193 @@
+package wasm
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+var ErrPoolClosed = errors.New("pool is closed")
+
+// Pool keeps instances of the same module so Run can be called concurrently.
+// Instances are created on demand and at most size of them are alive.
+type Pool struct {
+	newModule func(context.Context) (*Module, error)
+	// tenant enforces the quotas of the tenant that owns the pool, if any.
+	tenant *Tenant
+	idle   chan *Module
+	slots  chan struct{}
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewPool creates a pool of at most size instances. The first instance is
+// created eagerly so invalid modules are reported here.
+func NewPool(ctx context.Context, runtime *Runtime, wasmModule []byte, mainFuncName string, logExt LogFn, size int, opts ...ModuleOption) (*Pool, error) {
+	return newPool(ctx, nil, runtime, wasmModule, mainFuncName, logExt, size, opts...)
+}
+
+func newPool(ctx context.Context, tenant *Tenant, runtime *Runtime, wasmModule []byte, mainFuncName string, logExt LogFn, size int, opts ...ModuleOption) (*Pool, error) {
+	if size < 1 {
+		size = 1
+	}
+	p := &Pool{
+		newModule: func(ctx context.Context) (*Module, error) {
+			return NewModule(ctx, runtime, wasmModule, mainFuncName, logExt, opts...)
+		},
+		tenant: tenant,
+		idle:   make(chan *Module, size),
+		slots:  make(chan struct{}, size),
+	}
+	m, err := p.create(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.slots <- struct{}{}
+	p.idle <- m
+	return p, nil
+}
+
+// Get returns an idle instance or creates a new one. It blocks while all
+// instances are in use.
+func (p *Pool) Get(ctx context.Context) (*Module, error) {
+	p.mu.RLock()
+	closed := p.closed
+	p.mu.RUnlock()
+	if closed {
+		return nil, ErrPoolClosed
+	}
+	// prefer idle instances over creating new ones
+	select {
+	case m := <-p.idle:
+		return m, nil
+	default:
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case m := <-p.idle:
+		return m, nil
+	case p.slots <- struct{}{}:
+		m, err := p.create(ctx)
+		if err != nil {
+			<-p.slots
+			return nil, err
+		}
+		return m, nil
+	}
+}
+
+// create returns a new instance, if the quota of the tenant allows it. The
+// initial memory of the instance counts toward the quota.
+func (p *Pool) create(ctx context.Context) (*Module, error) {
+	if p.tenant != nil {
+		if err := p.tenant.acquire(ctx); err != nil {
+			return nil, err
+		}
+	}
+	m, err := p.newModule(ctx)
+	if err != nil {
+		if p.tenant != nil {
+			p.tenant.release(ctx, nil)
+		}
+		return nil, err
+	}
+	if p.tenant != nil {
+		if err := p.tenant.track(ctx, m); err != nil {
+			if err := m.Close(ctx); err != nil {
+				zerolog.Ctx(ctx).Warn().AnErr("err", err).Msg("Pool: error closing module")
+			}
+			p.tenant.release(ctx, m)
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Put gives back an instance obtained with Get.
+func (p *Pool) Put(ctx context.Context, m *Module) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		p.discard(ctx, m)
+		return
+	}
+	p.idle <- m
+}
+
+// Discard closes an instance obtained with Get that must not be reused.
+func (p *Pool) Discard(ctx context.Context, m *Module) {
+	p.discard(ctx, m)
+}
+
+func (p *Pool) discard(ctx context.Context, m *Module) {
+	if err := m.Close(ctx); err != nil {
+		zerolog.Ctx(ctx).Warn().AnErr("err", err).Msg("Pool: error closing module")
+	}
+	if p.tenant != nil {
+		p.tenant.release(ctx, m)
+	}
+	<-p.slots
+}
+
+// Run executes the module on an idle instance. Instances that fail are
+// discarded, since the guest may be left in an inconsistent state.
+func (p *Pool) Run(ctx context.Context, data string) (uint64, string, error) {
+	return p.RunStream(ctx, data, nil)
+}
+
+// RunStream executes the module on an idle instance like Run, delivering the
+// emitted payloads to emit.
+func (p *Pool) RunStream(ctx context.Context, data string, emit EmitFn) (uint64, string, error) {
+	if p.tenant != nil {
+		if err := p.tenant.admit(ctx); err != nil {
+			return 0, "", err
+		}
+	}
+	m, err := p.Get(ctx)
+	if err != nil {
+		return 0, "", err
+	}
+	code, res, err := m.RunStream(ctx, data, emit)
+	if err != nil {
+		p.Discard(ctx, m)
+		return 0, "", err
+	}
+	if p.tenant != nil {
+		if err := p.tenant.track(ctx, m); err != nil {
+			// the invocation already happened, so its result is returned and
+			// the instance that holds the memory over the quota is recycled
+			zerolog.Ctx(ctx).Warn().AnErr("err", err).Msg("Pool: instance recycled")
+			p.Discard(ctx, m)
+			return code, res, nil
+		}
+	}
+	p.Put(ctx, m)
+	return code, res, nil
+}
+
+// Close closes the idle instances. Instances in use are closed when they are
+// given back.
+func (p *Pool) Close(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrPoolClosed
+	}
+	p.closed = true
+	var errs error
+	for {
+		select {
+		case m := <-p.idle:
+			errs = errors.Join(errs, m.Close(ctx))
+			if p.tenant != nil {
+				p.tenant.release(ctx, m)
+			}
+			<-p.slots
+		default:
+			return errs
+		}
+	}
+}
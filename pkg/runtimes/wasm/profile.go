@@ -0,0 +1,338 @@
+package wasm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+const profilePath = "/debug/pprof/wasm/"
+
+// Profiler records every call of a sample of the invocations of the guests
+// and writes them as pprof profiles. The wall profile has the wall-clock time
+// spent in every function, including the time blocked in host functions,
+// which are labeled host=true. The allocation profile has the calls to the
+// malloc export of the guest.
+//
+// Profiling relies on the function listeners of wazero, which slow down the
+// guest, so it should only be enabled while looking for a problem.
+type Profiler struct {
+	sampleRate float64
+	mu         sync.Mutex
+	stacks     map[api.Module]*callStack
+	wall       map[string]*wallSample
+	allocs     map[string]*allocSample
+	start      time.Time
+}
+
+// callStack are the calls in flight of an instance. Only the frames of sampled
+// invocations are kept.
+type callStack struct {
+	depth   int
+	sampled bool
+	frames  []frame
+}
+
+type frame struct {
+	def      api.FunctionDefinition
+	start    time.Time
+	children time.Duration
+}
+
+type wallSample struct {
+	stack []api.FunctionDefinition
+	calls int64
+	nanos int64
+}
+
+type allocSample struct {
+	stack   []api.FunctionDefinition
+	objects int64
+	bytes   int64
+}
+
+// NewProfiler returns a profiler that samples sampleRate of the invocations.
+// Values out of (0, 1] sample every invocation.
+func NewProfiler(sampleRate float64) *Profiler {
+	if sampleRate <= 0 || sampleRate > 1 {
+		sampleRate = 1
+	}
+	p := &Profiler{sampleRate: sampleRate}
+	p.Reset()
+	return p
+}
+
+// Reset discards the samples taken so far.
+func (p *Profiler) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.wall = make(map[string]*wallSample)
+	p.allocs = make(map[string]*allocSample)
+	if p.stacks == nil {
+		p.stacks = make(map[api.Module]*callStack)
+	}
+	p.start = time.Now()
+}
+
+// NewFunctionListener implements experimental.FunctionListenerFactory.
+func (p *Profiler) NewFunctionListener(api.FunctionDefinition) experimental.FunctionListener {
+	return p
+}
+
+// Before implements experimental.FunctionListener.
+func (p *Profiler) Before(_ context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, _ experimental.StackIterator) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.stacks[mod]
+	if !ok {
+		s = &callStack{}
+		p.stacks[mod] = s
+	}
+	if s.depth == 0 {
+		s.sampled = p.sampleRate == 1 || rand.Float64() < p.sampleRate
+	}
+	s.depth++
+	if !s.sampled {
+		return
+	}
+	s.frames = append(s.frames, frame{def: def, start: time.Now()})
+	if def.GoFunction() == nil && def.Name() == "malloc" && len(params) > 0 {
+		key, stack := stackOf(s.frames)
+		a, ok := p.allocs[key]
+		if !ok {
+			a = &allocSample{stack: stack}
+			p.allocs[key] = a
+		}
+		a.objects++
+		a.bytes += int64(uint32(params[0]))
+	}
+}
+
+// After implements experimental.FunctionListener.
+func (p *Profiler) After(_ context.Context, mod api.Module, _ api.FunctionDefinition, _ []uint64) {
+	p.end(mod)
+}
+
+// Abort implements experimental.FunctionListener.
+func (p *Profiler) Abort(_ context.Context, mod api.Module, _ api.FunctionDefinition, _ error) {
+	p.end(mod)
+}
+
+func (p *Profiler) end(mod api.Module) {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.stacks[mod]
+	if !ok {
+		return
+	}
+	s.depth--
+	if s.depth <= 0 {
+		delete(p.stacks, mod)
+	}
+	if !s.sampled || len(s.frames) == 0 {
+		return
+	}
+	key, stack := stackOf(s.frames)
+	f := s.frames[len(s.frames)-1]
+	s.frames = s.frames[:len(s.frames)-1]
+	total := now.Sub(f.start)
+	if len(s.frames) > 0 {
+		s.frames[len(s.frames)-1].children += total
+	}
+	c, ok := p.wall[key]
+	if !ok {
+		c = &wallSample{stack: stack}
+		p.wall[key] = c
+	}
+	c.calls++
+	c.nanos += int64(total - f.children)
+}
+
+// stackOf returns the key and the functions of the stack, leaf first.
+func stackOf(frames []frame) (string, []api.FunctionDefinition) {
+	var key strings.Builder
+	stack := make([]api.FunctionDefinition, len(frames))
+	for i := range frames {
+		def := frames[len(frames)-1-i].def
+		stack[i] = def
+		key.WriteString(functionName(def))
+		key.WriteByte(0)
+	}
+	return key.String(), stack
+}
+
+// WriteWallProfile writes the wall-clock profile in the compressed pprof
+// format.
+func (p *Profiler) WriteWallProfile(w io.Writer) error {
+	p.mu.Lock()
+	b := newProfileBuilder(p.start,
+		[]*profile.ValueType{{Type: "calls", Unit: "count"}, {Type: "wall", Unit: "nanoseconds"}})
+	for _, c := range p.wall {
+		var labels map[string][]string
+		if c.stack[0].GoFunction() != nil {
+			labels = map[string][]string{"host": {"true"}}
+		}
+		b.add(c.stack, []int64{c.calls, c.nanos}, labels)
+	}
+	p.mu.Unlock()
+	return b.write(w)
+}
+
+// WriteAllocProfile writes the allocation profile in the compressed pprof
+// format.
+func (p *Profiler) WriteAllocProfile(w io.Writer) error {
+	p.mu.Lock()
+	b := newProfileBuilder(p.start,
+		[]*profile.ValueType{{Type: "alloc_objects", Unit: "count"}, {Type: "alloc_space", Unit: "bytes"}})
+	for _, a := range p.allocs {
+		b.add(a.stack, []int64{a.objects, a.bytes}, nil)
+	}
+	p.mu.Unlock()
+	return b.write(w)
+}
+
+type profileBuilder struct {
+	p         *profile.Profile
+	locations map[string]*profile.Location
+}
+
+func newProfileBuilder(start time.Time, sampleTypes []*profile.ValueType) *profileBuilder {
+	return &profileBuilder{
+		p: &profile.Profile{
+			SampleType:    sampleTypes,
+			PeriodType:    sampleTypes[len(sampleTypes)-1],
+			Period:        1,
+			TimeNanos:     start.UnixNano(),
+			DurationNanos: time.Since(start).Nanoseconds(),
+		},
+		locations: make(map[string]*profile.Location),
+	}
+}
+
+func (b *profileBuilder) add(stack []api.FunctionDefinition, values []int64, labels map[string][]string) {
+	locations := make([]*profile.Location, len(stack))
+	for i, def := range stack {
+		name := functionName(def)
+		l, ok := b.locations[name]
+		if !ok {
+			fn := &profile.Function{
+				ID:         uint64(len(b.p.Function) + 1),
+				Name:       name,
+				SystemName: name,
+				Filename:   def.ModuleName(),
+			}
+			b.p.Function = append(b.p.Function, fn)
+			l = &profile.Location{
+				ID:   uint64(len(b.p.Location) + 1),
+				Line: []profile.Line{{Function: fn}},
+			}
+			b.p.Location = append(b.p.Location, l)
+			b.locations[name] = l
+		}
+		locations[i] = l
+	}
+	b.p.Sample = append(b.p.Sample, &profile.Sample{
+		Location: locations,
+		Value:    values,
+		Label:    labels,
+	})
+}
+
+// functionName returns the name of the function qualified by its module. Guests
+// usually have no module name, so only the function name is used.
+func functionName(def api.FunctionDefinition) string {
+	if def.ModuleName() == "" && def.Name() != "" {
+		return def.Name()
+	}
+	return def.DebugName()
+}
+
+func (b *profileBuilder) write(w io.Writer) error {
+	if err := b.p.CheckValid(); err != nil {
+		return err
+	}
+	return b.p.Write(w)
+}
+
+var profilers = struct {
+	sync.Mutex
+	once sync.Once
+	m    map[string]*Profiler
+}{m: make(map[string]*Profiler)}
+
+// RegisterProfiler serves the profiles of p on http.DefaultServeMux, which
+// service.AttachProfilingHandlers mounts, at /debug/pprof/wasm/wall?module=name
+// and /debug/pprof/wasm/allocs?module=name. With seconds=N the samples are
+// reset and the profile covers the next N seconds.
+func RegisterProfiler(name string, p *Profiler) {
+	profilers.once.Do(func() {
+		http.HandleFunc(profilePath, serveProfile)
+	})
+	profilers.Lock()
+	defer profilers.Unlock()
+	profilers.m[name] = p
+}
+
+// UnregisterProfiler stops serving the profiles of the module.
+func UnregisterProfiler(name string) {
+	profilers.Lock()
+	defer profilers.Unlock()
+	delete(profilers.m, name)
+}
+
+func serveProfile(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("module")
+	profilers.Lock()
+	p, ok := profilers.m[name]
+	names := make([]string, 0, len(profilers.m))
+	for n := range profilers.m {
+		names = append(names, n)
+	}
+	profilers.Unlock()
+	kind := strings.TrimPrefix(r.URL.Path, profilePath)
+	if kind != "wall" && kind != "allocs" {
+		http.Error(w, "unknown profile, use wall or allocs", http.StatusNotFound)
+		return
+	}
+	if !ok {
+		sort.Strings(names)
+		http.Error(w, fmt.Sprintf("unknown module %q, profiled modules: %s", name, strings.Join(names, ", ")), http.StatusNotFound)
+		return
+	}
+	if s := r.URL.Query().Get("seconds"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds <= 0 {
+			http.Error(w, "invalid seconds", http.StatusBadRequest)
+			return
+		}
+		p.Reset()
+		select {
+		case <-time.After(time.Duration(seconds) * time.Second):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s.pb.gz"`, name, kind))
+	var err error
+	if kind == "wall" {
+		err = p.WriteWallProfile(w)
+	} else {
+		err = p.WriteAllocProfile(w)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
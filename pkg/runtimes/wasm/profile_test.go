@@ -0,0 +1,97 @@
+package wasm_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"unsafe"
+
+	"github.com/andrescosta/goico/pkg/runtimes/wasm"
+	"github.com/andrescosta/goico/pkg/service"
+	"github.com/andrescosta/goico/pkg/test"
+	"github.com/google/pprof/profile"
+	"github.com/gorilla/mux"
+)
+
+func TestProfiler(t *testing.T) {
+	ctx := context.Background()
+	runtime := wasm.NewInterpreterRuntime()
+	defer func() {
+		err := runtime.Close(ctx)
+		test.Nil(t, err)
+	}()
+	profiler := wasm.NewProfiler(1)
+	m, err := wasm.NewModule(ctx, runtime, replayw, "event", log,
+		wasm.WithName("replay"),
+		wasm.WithProfiler(profiler))
+	test.Nil(t, err)
+	defer m.Close(ctx)
+	for i := 0; i < 3; i++ {
+		_, _, err := m.Run(ctx, "profiled")
+		test.Nil(t, err)
+	}
+
+	t.Run("wall", func(t *testing.T) {
+		var buf bytes.Buffer
+		err := profiler.WriteWallProfile(&buf)
+		test.Nil(t, err)
+		p, err := profile.Parse(&buf)
+		test.Nil(t, err)
+		test.Equals(t, p.SampleType[0].Type, "calls")
+		test.Equals(t, p.SampleType[1].Type, "wall")
+		test.Equals(t, p.SampleType[1].Unit, "nanoseconds")
+		var event, host bool
+		for _, s := range p.Sample {
+			leaf := s.Location[0].Line[0].Function.Name
+			if leaf == "event" {
+				event = true
+				test.Equals(t, s.Value[0], int64(3))
+			}
+			if leaf == "env.log" {
+				host = true
+				test.Equals(t, s.Label["host"], []string{"true"})
+				test.Equals(t, s.Location[1].Line[0].Function.Name, "event")
+			}
+		}
+		test.Equals(t, event, true)
+		test.Equals(t, host, true)
+	})
+	t.Run("allocs", func(t *testing.T) {
+		var buf bytes.Buffer
+		err := profiler.WriteAllocProfile(&buf)
+		test.Nil(t, err)
+		p, err := profile.Parse(&buf)
+		test.Nil(t, err)
+		var bytes int64
+		for _, s := range p.Sample {
+			// the result and the input allocated by the host
+			if len(s.Location) == 1 && s.Location[0].Line[0].Function.Name == "malloc" {
+				bytes += s.Value[1]
+			}
+		}
+		test.Equals(t, bytes, int64(3*(unsafe.Sizeof(wasm.EventFuncResult{})+uintptr(len("profiled")))))
+	})
+	t.Run("handler", func(t *testing.T) {
+		wasm.RegisterProfiler("replay", profiler)
+		defer wasm.UnregisterProfiler("replay")
+		router := mux.NewRouter()
+		service.AttachProfilingHandlers(router)
+		srv := httptest.NewServer(router)
+		defer srv.Close()
+
+		res, err := http.Get(srv.URL + "/debug/pprof/wasm/wall?module=replay")
+		test.Nil(t, err)
+		defer res.Body.Close()
+		test.Equals(t, res.StatusCode, http.StatusOK)
+		p, err := profile.Parse(res.Body)
+		test.Nil(t, err)
+		test.NotNil(t, p.Sample)
+
+		res, err = http.Get(srv.URL + "/debug/pprof/wasm/allocs?module=other")
+		test.Nil(t, err)
+		res.Body.Close()
+		test.Equals(t, res.StatusCode, http.StatusNotFound)
+	})
+}
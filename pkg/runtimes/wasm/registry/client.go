@@ -0,0 +1,83 @@
+package registry
+
+import (
+	"context"
+
+	"github.com/andrescosta/goico/pkg/runtimes/wasm/registry/modules"
+	"github.com/andrescosta/goico/pkg/service"
+	rpc "google.golang.org/grpc"
+)
+
+type Client struct {
+	serverAddr string
+	conn       *rpc.ClientConn
+	client     modules.RegistryClient
+}
+
+func NewClient(ctx context.Context, addr string, d service.GrpcDialer) (*Client, error) {
+	conn, err := d.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		serverAddr: addr,
+		conn:       conn,
+		client:     modules.NewRegistryClient(conn),
+	}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Upload stores a new version of the module and optionally makes it the
+// active one.
+func (c *Client) Upload(ctx context.Context, tenant, name string, wasmModule []byte, activate bool) (*modules.ModuleVersion, error) {
+	r, err := c.client.Upload(ctx, &modules.UploadRequest{
+		Tenant:   tenant,
+		Name:     name,
+		Wasm:     wasmModule,
+		Activate: activate,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.Version, nil
+}
+
+// ListVersions returns the versions of the module, or of every module of the
+// tenant when name is empty.
+func (c *Client) ListVersions(ctx context.Context, tenant, name string) ([]*modules.ModuleVersion, error) {
+	r, err := c.client.ListVersions(ctx, &modules.ListVersionsRequest{Tenant: tenant, Name: name})
+	if err != nil {
+		return nil, err
+	}
+	return r.Versions, nil
+}
+
+func (c *Client) SetActive(ctx context.Context, tenant, name, version string) (*modules.ModuleVersion, error) {
+	r, err := c.client.SetActive(ctx, &modules.SetActiveRequest{Tenant: tenant, Name: name, Version: version})
+	if err != nil {
+		return nil, err
+	}
+	return r.Version, nil
+}
+
+// Download returns the content of the version, or of the active one when
+// version is empty.
+func (c *Client) Download(ctx context.Context, tenant, name, version string) ([]byte, *modules.ModuleVersion, error) {
+	r, err := c.client.Download(ctx, &modules.DownloadRequest{Tenant: tenant, Name: name, Version: version})
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.Wasm, r.Version, nil
+}
+
+// Invoke executes the version, or the active one when version is empty.
+func (c *Client) Invoke(ctx context.Context, tenant, name, version, data string) (uint64, string, error) {
+	r, err := c.client.Invoke(ctx, &modules.InvokeRequest{Tenant: tenant, Name: name, Version: version, Data: data})
+	if err != nil {
+		return 0, "", err
+	}
+	return r.Errno, r.Result, nil
+}
@@ -0,0 +1,99 @@
+package registry_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andrescosta/goico/pkg/database"
+	"github.com/andrescosta/goico/pkg/runtimes/wasm"
+	"github.com/andrescosta/goico/pkg/runtimes/wasm/registry"
+	"github.com/andrescosta/goico/pkg/service"
+	"github.com/andrescosta/goico/pkg/test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const addr = "registry:1"
+
+func TestRegistry(t *testing.T) {
+	t.Setenv("wasm_registry.addr", addr)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := start(ctx, t)
+
+	echo, err := os.ReadFile(filepath.Join("..", "testdata", "echo.wasm"))
+	test.Nil(t, err)
+	doerror, err := os.ReadFile(filepath.Join("..", "testdata", "error.wasm"))
+	test.Nil(t, err)
+
+	v1, err := client.Upload(ctx, "tenant", "mod", echo, true)
+	test.Nil(t, err)
+	test.Equals(t, v1.Version, wasm.Hash(echo))
+	test.Equals(t, v1.Active, true)
+	test.Equals(t, v1.Abi, "default")
+	v2, err := client.Upload(ctx, "tenant", "mod", doerror, false)
+	test.Nil(t, err)
+	test.Equals(t, v2.Active, false)
+	again, err := client.Upload(ctx, "tenant", "mod", echo, false)
+	test.Nil(t, err)
+	test.Equals(t, again.Version, v1.Version)
+
+	vs, err := client.ListVersions(ctx, "tenant", "mod")
+	test.Nil(t, err)
+	test.Len(t, vs, 2)
+	vs, err = client.ListVersions(ctx, "other", "")
+	test.Nil(t, err)
+	test.Len(t, vs, 0)
+
+	errno, res, err := client.Invoke(ctx, "tenant", "mod", "", "test_ok")
+	test.Nil(t, err)
+	test.Equals(t, errno, uint64(0))
+	test.Equals(t, res, "test_ok")
+	errno, res, err = client.Invoke(ctx, "tenant", "mod", v2.Version, "test_error")
+	test.Nil(t, err)
+	test.Equals(t, errno, uint64(500))
+	test.Equals(t, res, "test_error")
+
+	a, err := client.SetActive(ctx, "tenant", "mod", v2.Version)
+	test.Nil(t, err)
+	test.Equals(t, a.Active, true)
+	b, d, err := client.Download(ctx, "tenant", "mod", "")
+	test.Nil(t, err)
+	test.Equals(t, d.Version, v2.Version)
+	test.Equals(t, string(b), string(doerror))
+
+	_, err = client.Upload(ctx, "tenant", "invalid", []byte("not wasm"), true)
+	test.Equals(t, status.Code(err), codes.InvalidArgument)
+	_, err = client.Upload(ctx, "", "mod", echo, true)
+	test.Equals(t, status.Code(err), codes.InvalidArgument)
+	_, _, err = client.Invoke(ctx, "tenant", "unknown", "", "")
+	test.Equals(t, status.Code(err), codes.NotFound)
+	_, _, err = client.Download(ctx, "tenant", "mod", "unknown")
+	test.Equals(t, status.Code(err), codes.NotFound)
+}
+
+func start(ctx context.Context, t *testing.T) *registry.Client {
+	t.Helper()
+	db, err := database.Open(ctx, filepath.Join(t.TempDir(), "db"), database.Option{InMemory: true})
+	test.Nil(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	runtime := wasm.NewRuntime(wasm.WithInterpreter())
+	t.Cleanup(func() { _ = runtime.Close(context.Background()) })
+	conn := service.NewBufConnWithTimeout(5 * time.Second)
+	t.Cleanup(conn.CloseAll)
+	svc, err := registry.NewService(ctx, db, runtime,
+		registry.WithGrpcConn(service.GrpcConn{Dialer: conn, Listener: conn}))
+	test.Nil(t, err)
+	errch := make(chan error, 1)
+	go func() {
+		errch <- svc.Serve()
+	}()
+	t.Cleanup(func() { test.Nil(t, <-errch) })
+	client, err := registry.NewClient(ctx, addr, conn)
+	test.Nil(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
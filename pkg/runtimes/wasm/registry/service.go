@@ -0,0 +1,256 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/andrescosta/goico/pkg/database"
+	"github.com/andrescosta/goico/pkg/runtimes/wasm"
+	"github.com/andrescosta/goico/pkg/runtimes/wasm/registry/modules"
+	"github.com/andrescosta/goico/pkg/service"
+	"github.com/andrescosta/goico/pkg/service/grpc"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const name = "wasm_registry"
+
+type server struct {
+	modules.UnimplementedRegistryServer
+	store        *store
+	runtime      *wasm.Runtime
+	mainFuncName string
+	poolSize     int
+	mu           sync.Mutex
+	pools        map[string]*wasm.Pool
+}
+
+type (
+	Setter  func(*Service)
+	Service struct {
+		grpc.Container
+		mainFuncName string
+		poolSize     int
+	}
+)
+
+// NewService returns the registry service. Modules are stored in db and
+// invoked with runtime.
+func NewService(ctx context.Context, db *database.Database, runtime *wasm.Runtime, ops ...Setter) (*Service, error) {
+	s := &Service{
+		Container: grpc.Container{
+			Name: name,
+			GrpcConn: service.GrpcConn{
+				Dialer:   service.DefaultGrpcDialer,
+				Listener: service.DefaultGrpcListener,
+			},
+		},
+		mainFuncName: "event",
+		poolSize:     1,
+	}
+	for _, op := range ops {
+		op(s)
+	}
+	svc, err := grpc.New(
+		grpc.WithName(name),
+		grpc.WithListener(s.Listener),
+		grpc.WithAddr(s.AddrOrPanic()),
+		grpc.WithContext(ctx),
+		grpc.WithServiceDesc(&modules.Registry_ServiceDesc),
+		grpc.WithNewServiceFn(func(_ context.Context) (any, error) {
+			return &server{
+				store:        newStore(db),
+				runtime:      runtime,
+				mainFuncName: s.mainFuncName,
+				poolSize:     s.poolSize,
+				pools:        make(map[string]*wasm.Pool),
+			}, nil
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	s.Svc = svc
+	return s, nil
+}
+
+func (s *Service) Serve() (err error) {
+	defer s.Svc.Dispose()
+	return s.Svc.Serve()
+}
+
+func (s *Service) Dispose() {
+	s.Svc.Dispose()
+}
+
+func (s *server) Upload(_ context.Context, in *modules.UploadRequest) (*modules.UploadReply, error) {
+	v, err := s.store.Add(in.Tenant, in.Name, in.Wasm, s.mainFuncName)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	if in.Activate {
+		if _, err := s.store.SetActive(in.Tenant, in.Name, v.Version); err != nil {
+			return nil, toStatus(err)
+		}
+	}
+	mv, err := s.moduleVersion(in.Tenant, v)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &modules.UploadReply{Version: mv}, nil
+}
+
+func (s *server) ListVersions(_ context.Context, in *modules.ListVersionsRequest) (*modules.ListVersionsReply, error) {
+	vs, err := s.store.Versions(in.Tenant, in.Name)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	reply := &modules.ListVersionsReply{Versions: make([]*modules.ModuleVersion, 0, len(vs))}
+	for i := range vs {
+		mv, err := s.moduleVersion(in.Tenant, &vs[i])
+		if err != nil {
+			return nil, toStatus(err)
+		}
+		reply.Versions = append(reply.Versions, mv)
+	}
+	return reply, nil
+}
+
+func (s *server) SetActive(_ context.Context, in *modules.SetActiveRequest) (*modules.SetActiveReply, error) {
+	if in.Version == "" {
+		return nil, status.Error(codes.InvalidArgument, "version cannot be empty")
+	}
+	v, err := s.store.SetActive(in.Tenant, in.Name, in.Version)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	mv, err := s.moduleVersion(in.Tenant, v)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &modules.SetActiveReply{Version: mv}, nil
+}
+
+func (s *server) Download(_ context.Context, in *modules.DownloadRequest) (*modules.DownloadReply, error) {
+	v, err := s.store.Version(in.Tenant, in.Name, in.Version)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	b, err := s.store.Wasm(in.Tenant, v.Version)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	mv, err := s.moduleVersion(in.Tenant, v)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &modules.DownloadReply{Version: mv, Wasm: b}, nil
+}
+
+func (s *server) Invoke(ctx context.Context, in *modules.InvokeRequest) (*modules.InvokeReply, error) {
+	v, err := s.store.Version(in.Tenant, in.Name, in.Version)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	pool, err := s.pool(ctx, in.Tenant, v)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	errno, res, err := pool.Run(ctx, in.Data)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &modules.InvokeReply{Errno: errno, Result: res, Version: v.Version}, nil
+}
+
+// pool returns the pool of the version, creating it on first use. Versions
+// are immutable, so pools are never replaced.
+func (s *server) pool(ctx context.Context, tenant string, v *version) (*wasm.Pool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := tenant + "/" + v.id()
+	if p, ok := s.pools[key]; ok {
+		return p, nil
+	}
+	b, err := s.store.Wasm(tenant, v.Version)
+	if err != nil {
+		return nil, err
+	}
+	mode := wasm.ModeReactor
+	if v.ABI == "command" {
+		mode = wasm.ModeCommand
+	}
+	p, err := wasm.NewPool(ctx, s.runtime, b, s.mainFuncName, nil, s.poolSize,
+		wasm.WithName(v.Name), wasm.WithVersion(v.Version), wasm.WithMode(mode))
+	if err != nil {
+		return nil, err
+	}
+	s.pools[key] = p
+	return p, nil
+}
+
+func (s *server) moduleVersion(tenant string, v *version) (*modules.ModuleVersion, error) {
+	a, err := s.store.Active(tenant, v.Name)
+	if err != nil && !errors.Is(err, ErrNoActive) {
+		return nil, err
+	}
+	return &modules.ModuleVersion{
+		Tenant:    tenant,
+		Name:      v.Name,
+		Version:   v.Version,
+		Size:      v.Size,
+		CreatedAt: v.CreatedAt.Unix(),
+		Abi:       v.ABI,
+		Active:    a == v.Version,
+	}, nil
+}
+
+// Close closes the pools of the invoked modules.
+func (s *server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ctx := context.Background()
+	var errs error
+	for key, p := range s.pools {
+		if err := p.Close(ctx); err != nil {
+			zerolog.Ctx(ctx).Warn().AnErr("err", err).Str("module", key).Msg("Registry: error closing pool")
+			errs = errors.Join(errs, err)
+		}
+		delete(s.pools, key)
+	}
+	return errs
+}
+
+func toStatus(err error) error {
+	var execErr *wasm.ExecError
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrNoActive):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrEmptyName), errors.Is(err, wasm.ErrInvalidModule):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.As(err, &execErr):
+		return status.Error(codes.Aborted, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func WithGrpcConn(g service.GrpcConn) Setter {
+	return func(s *Service) {
+		s.Container.GrpcConn = g
+	}
+}
+
+func WithMainFuncName(n string) Setter {
+	return func(s *Service) {
+		s.mainFuncName = n
+	}
+}
+
+func WithPoolSize(size int) Setter {
+	return func(s *Service) {
+		s.poolSize = size
+	}
+}
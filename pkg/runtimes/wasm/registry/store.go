@@ -0,0 +1,204 @@
+package registry
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/andrescosta/goico/pkg/database"
+	"github.com/andrescosta/goico/pkg/runtimes/wasm"
+)
+
+const (
+	blobsTable    = "wasm_blobs"
+	versionsTable = "wasm_versions"
+	activeTable   = "wasm_active"
+)
+
+var (
+	ErrNotFound  = errors.New("module not found")
+	ErrNoActive  = errors.New("module has no active version")
+	ErrEmptyName = errors.New("tenant and name cannot be empty")
+)
+
+// blob is the content of a module. Blobs are shared by the versions of every
+// module of the tenant with the same content.
+type blob struct {
+	Version string
+	Wasm    []byte
+}
+
+type version struct {
+	Name      string
+	Version   string
+	Size      int64
+	CreatedAt time.Time
+	ABI       string
+}
+
+type active struct {
+	Name    string
+	Version string
+}
+
+// store keeps the modules of every tenant in a database.
+type store struct {
+	db *database.Database
+}
+
+func newStore(db *database.Database) *store {
+	return &store{db: db}
+}
+
+// Add validates and stores a new version of the module. Adding the same
+// content twice returns the existing version.
+func (s *store) Add(tenant, name string, wasmModule []byte, mainFuncName string) (*version, error) {
+	if tenant == "" || name == "" {
+		return nil, ErrEmptyName
+	}
+	info, err := wasm.Inspect(wasmModule)
+	if err != nil {
+		return nil, err
+	}
+	if err := info.Validate(info.Mode, mainFuncName); err != nil {
+		return nil, err
+	}
+	v := version{
+		Name:      name,
+		Version:   wasm.Hash(wasmModule),
+		Size:      int64(len(wasmModule)),
+		CreatedAt: time.Now(),
+		ABI:       abi(info),
+	}
+	existing, err := s.versions(tenant).Get(v.id())
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return existing, nil
+	}
+	if err := s.blobs(tenant).Add(blob{Version: v.Version, Wasm: wasmModule}); err != nil {
+		return nil, err
+	}
+	if err := s.versions(tenant).Add(v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Versions returns the versions of the module, or of every module of the
+// tenant when name is empty, sorted by name and creation time.
+func (s *store) Versions(tenant, name string) ([]version, error) {
+	all, err := s.versions(tenant).All()
+	if err != nil {
+		return nil, err
+	}
+	vs := make([]version, 0, len(all))
+	for _, v := range all {
+		if name == "" || v.Name == name {
+			vs = append(vs, v)
+		}
+	}
+	sort.Slice(vs, func(i, j int) bool {
+		if vs[i].Name != vs[j].Name {
+			return vs[i].Name < vs[j].Name
+		}
+		return vs[i].CreatedAt.Before(vs[j].CreatedAt)
+	})
+	return vs, nil
+}
+
+// Version returns the version of the module, or the active one when v is
+// empty.
+func (s *store) Version(tenant, name, v string) (*version, error) {
+	if v == "" {
+		a, err := s.Active(tenant, name)
+		if err != nil {
+			return nil, err
+		}
+		v = a
+	}
+	ver, err := s.versions(tenant).Get(version{Name: name, Version: v}.id())
+	if err != nil {
+		return nil, err
+	}
+	if ver == nil {
+		return nil, ErrNotFound
+	}
+	return ver, nil
+}
+
+// Wasm returns the content of the version.
+func (s *store) Wasm(tenant, v string) ([]byte, error) {
+	b, err := s.blobs(tenant).Get(v)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, ErrNotFound
+	}
+	return b.Wasm, nil
+}
+
+// SetActive makes v the version served when no version is requested.
+func (s *store) SetActive(tenant, name, v string) (*version, error) {
+	ver, err := s.Version(tenant, name, v)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.actives(tenant).Update(active{Name: name, Version: ver.Version}); err != nil {
+		return nil, err
+	}
+	return ver, nil
+}
+
+// Active returns the active version of the module.
+func (s *store) Active(tenant, name string) (string, error) {
+	a, err := s.actives(tenant).Get(name)
+	if err != nil {
+		return "", err
+	}
+	if a == nil {
+		return "", ErrNoActive
+	}
+	return a.Version, nil
+}
+
+func (s *store) blobs(tenant string) *database.Table[blob] {
+	return database.NewTable(s.db, blobsTable, tenant, database.BinaryMarshaller[blob]{})
+}
+
+func (s *store) versions(tenant string) *database.Table[version] {
+	return database.NewTable(s.db, versionsTable, tenant, database.BinaryMarshaller[version]{})
+}
+
+func (s *store) actives(tenant string) *database.Table[active] {
+	return database.NewTable(s.db, activeTable, tenant, database.BinaryMarshaller[active]{})
+}
+
+func (b blob) ID() string {
+	return b.Version
+}
+
+func (v version) ID() string {
+	return v.id()
+}
+
+func (v version) id() string {
+	return v.Name + "@" + v.Version
+}
+
+func (a active) ID() string {
+	return a.Name
+}
+
+func abi(info *wasm.ModuleInfo) string {
+	switch {
+	case info.Mode == wasm.ModeCommand:
+		return "command"
+	case info.ABI == wasm.TypeRust:
+		return "rust"
+	default:
+		return "default"
+	}
+}
@@ -0,0 +1,505 @@
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+var (
+	ErrReplayDiverged       = errors.New("replay diverged")
+	ErrReplayModuleMismatch = errors.New("module does not match the recording")
+)
+
+// EventKind identifies an interaction between the guest and the host.
+type EventKind string
+
+const (
+	EventLog      EventKind = "log"
+	EventEmit     EventKind = "emit"
+	EventWalltime EventKind = "walltime"
+	EventNanotime EventKind = "nanotime"
+	EventRandom   EventKind = "random"
+	EventFetch    EventKind = "fetch"
+	EventConfig   EventKind = "config"
+	// EventResult is not recorded, it describes the result of the execution
+	// when it diverges.
+	EventResult EventKind = "result"
+)
+
+// Event is an interaction between the guest and the host, with the value the
+// host returned.
+type Event struct {
+	Kind EventKind `json:"kind"`
+	// Level is the level of a log.
+	Level uint32 `json:"level,omitempty"`
+	// Data is the message of a log, the payload of an emit, the bytes of a
+	// random read, the request of a fetch, the key of a config or the output
+	// of a result.
+	Data []byte `json:"data,omitempty"`
+	// Response is the response of a fetch or the value of a config. The
+	// values of the secrets are not recorded.
+	Response []byte `json:"response,omitempty"`
+	// Value is the seconds of a walltime, the nanoseconds of a nanotime, the
+	// value returned to the guest by emit, fetch or config or the errno of a
+	// result.
+	Value int64 `json:"value,omitempty"`
+	// Nsec is the nanoseconds of a walltime.
+	Nsec int32 `json:"nsec,omitempty"`
+	// Error is the error that aborted an emit or the execution.
+	Error string `json:"error,omitempty"`
+}
+
+func (e *Event) String() string {
+	if e == nil {
+		return "<none>"
+	}
+	switch e.Kind {
+	case EventWalltime:
+		return fmt.Sprintf("%s(%d.%09d)", e.Kind, e.Value, e.Nsec)
+	case EventNanotime:
+		return fmt.Sprintf("%s(%d)", e.Kind, e.Value)
+	case EventRandom:
+		return fmt.Sprintf("%s(%d bytes)", e.Kind, len(e.Data))
+	case EventLog:
+		return fmt.Sprintf("%s(%d, %q)", e.Kind, e.Level, e.Data)
+	default:
+		return fmt.Sprintf("%s(%d, %q, %q)", e.Kind, e.Value, e.Data, e.Error)
+	}
+}
+
+// Recording is a replay file: the input of an execution, every interaction of
+// the guest with the host and the result.
+type Recording struct {
+	Name     string   `json:"name,omitempty"`
+	Version  string   `json:"version,omitempty"`
+	Hash     string   `json:"hash"`
+	MainFunc string   `json:"main_func"`
+	Mode     ExecMode `json:"mode"`
+	// Init are the events of the instantiation of the module.
+	Init   []Event `json:"init,omitempty"`
+	Input  string  `json:"input"`
+	Events []Event `json:"events,omitempty"`
+	Errno  uint64  `json:"errno"`
+	Output string  `json:"output"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// RecordFn receives the recording of every execution.
+type RecordFn func(context.Context, *Recording) error
+
+// DivergenceError reports the first event where the replay did not behave
+// like the recording.
+type DivergenceError struct {
+	// Init is true when the divergence happened instantiating the module.
+	Init     bool
+	Index    int
+	Expected *Event
+	Actual   *Event
+}
+
+func (e *DivergenceError) Error() string {
+	phase := "run"
+	if e.Init {
+		phase = "init"
+	}
+	return fmt.Sprintf("%s at %s event %d: expected %s, got %s", ErrReplayDiverged, phase, e.Index, e.Expected, e.Actual)
+}
+
+func (e *DivergenceError) Unwrap() error {
+	return ErrReplayDiverged
+}
+
+// RecordToDir returns a RecordFn that writes every recording to a file in dir.
+func RecordToDir(dir string) RecordFn {
+	return func(_ context.Context, r *Recording) error {
+		name := r.Name
+		if name == "" {
+			name = r.Hash
+		}
+		f, err := os.CreateTemp(dir, fmt.Sprintf("%s-%d-*.replay.json", filepath.Base(name), time.Now().UnixNano()))
+		if err != nil {
+			return err
+		}
+		if err := r.Encode(f); err != nil {
+			_ = f.Close()
+			return err
+		}
+		return f.Close()
+	}
+}
+
+// Encode writes the recording as JSON.
+func (r *Recording) Encode(w io.Writer) error {
+	return json.NewEncoder(w).Encode(r)
+}
+
+func DecodeRecording(r io.Reader) (*Recording, error) {
+	var rec Recording
+	if err := json.NewDecoder(r).Decode(&rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func ReadRecording(path string) (*Recording, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return DecodeRecording(f)
+}
+
+// Replay executes the module with the input of the recording, returning to
+// the guest the values recorded for the clock, the random source and the
+// emits. It returns a DivergenceError if the guest does not interact with the
+// host as recorded or the result is different.
+//
+// Reactor modules are instantiated again, so the state left in the guest
+// memory by the executions before the recorded one is not reproduced.
+func Replay(ctx context.Context, runtime *Runtime, wasmModule []byte, rec *Recording) error {
+	if Hash(wasmModule) != rec.Hash {
+		return ErrReplayModuleMismatch
+	}
+	t := &tape{
+		replay: true,
+		init:   true,
+		events: rec.Init,
+	}
+	// the fetches are replayed from the tape, the config denies the others
+	m, err := NewModule(ctx, runtime, wasmModule, rec.MainFunc, nil,
+		WithName(rec.Name), WithVersion(rec.Version), WithMode(rec.Mode),
+		WithHTTPFetch(&HTTPFetchConfig{}), withTape(t))
+	if err != nil {
+		if d := t.divergence(); d != nil {
+			return d
+		}
+		return err
+	}
+	defer m.Close(ctx)
+	if d := t.end(); d != nil {
+		return d
+	}
+	t.start(rec.Events)
+	errno, res, err := m.Run(ctx, rec.Input)
+	if d := t.end(); d != nil {
+		return d
+	}
+	expected := &Event{Kind: EventResult, Value: int64(rec.Errno), Data: []byte(rec.Output), Error: rec.Error}
+	actual := resultEvent(errno, res, err)
+	if expected.Value != actual.Value || !bytes.Equal(expected.Data, actual.Data) || expected.Error != actual.Error {
+		return &DivergenceError{Index: len(rec.Events), Expected: expected, Actual: actual}
+	}
+	return nil
+}
+
+func resultEvent(errno uint64, res string, err error) *Event {
+	e := &Event{Kind: EventResult, Value: int64(errno), Data: []byte(res)}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+// tape records the events of a module, or returns the recorded ones when
+// replaying.
+type tape struct {
+	mu     sync.Mutex
+	replay bool
+	init   bool
+	// initEvents are the events of the instantiation, kept for the
+	// recordings of every execution.
+	initEvents []Event
+	events     []Event
+	pos        int
+	diverg     *DivergenceError
+	// sources of the recorded values
+	clock *Clock
+	rand  io.Reader
+}
+
+func newTape(c *ModuleConfig) *tape {
+	t := &tape{
+		init:  true,
+		clock: c.Clock,
+		rand:  c.RandSource,
+	}
+	// the same values wazero returns when no source is configured
+	if t.clock == nil {
+		t.clock = NewClock(time.Unix(1640995200, 0), time.Millisecond)
+	}
+	if t.rand == nil {
+		t.rand = rand.New(rand.NewSource(42))
+	}
+	return t
+}
+
+// start begins a new execution and returns the events of the instantiation.
+// When replaying, events are the recorded ones.
+func (t *tape) start(events []Event) []Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.init {
+		t.initEvents = t.events
+		t.init = false
+	}
+	t.pos = 0
+	t.events = events
+	return t.initEvents
+}
+
+// end returns the divergence of the execution, including recorded events
+// that did not happen.
+func (t *tape) end() *DivergenceError {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.diverg == nil && t.replay && t.pos < len(t.events) {
+		t.diverge(&t.events[t.pos], nil)
+	}
+	return t.diverg
+}
+
+func (t *tape) divergence() *DivergenceError {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.diverg
+}
+
+func (t *tape) recorded() []Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.events
+}
+
+// next returns the recorded event that matches actual. The bool is false on
+// divergence.
+func (t *tape) next(actual *Event, match func(expected *Event) bool) (*Event, bool) {
+	if t.diverg != nil {
+		return nil, false
+	}
+	if t.pos >= len(t.events) {
+		t.diverge(nil, actual)
+		return nil, false
+	}
+	expected := &t.events[t.pos]
+	if expected.Kind != actual.Kind || (match != nil && !match(expected)) {
+		t.diverge(expected, actual)
+		return nil, false
+	}
+	t.pos++
+	return expected, true
+}
+
+func (t *tape) diverge(expected, actual *Event) {
+	t.diverg = &DivergenceError{
+		Init:     t.init,
+		Index:    t.pos,
+		Expected: expected,
+		Actual:   actual,
+	}
+}
+
+func (t *tape) log(level uint32, msg string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	actual := Event{Kind: EventLog, Level: level, Data: []byte(msg)}
+	if !t.replay {
+		t.events = append(t.events, actual)
+		return
+	}
+	t.next(&actual, func(e *Event) bool {
+		return e.Level == level && bytes.Equal(e.Data, actual.Data)
+	})
+}
+
+// emit records the result of fn, or returns the recorded one without calling
+// fn.
+func (t *tape) emit(payload []byte, fn func() (uint32, error)) (uint32, error) {
+	if !t.replay {
+		res, err := fn()
+		e := Event{Kind: EventEmit, Data: payload, Value: int64(res)}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		t.mu.Lock()
+		t.events = append(t.events, e)
+		t.mu.Unlock()
+		return res, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.next(&Event{Kind: EventEmit, Data: payload}, func(e *Event) bool {
+		return bytes.Equal(e.Data, payload)
+	})
+	if !ok {
+		return emitNoStream, nil
+	}
+	if e.Error != "" {
+		return 0, errors.New(e.Error)
+	}
+	return uint32(e.Value), nil
+}
+
+// fetch records the result of fn, or returns the recorded one without calling
+// fn, so replays do not reach the network.
+func (t *tape) fetch(req []byte, fn func() (uint32, []byte)) (uint32, []byte) {
+	if !t.replay {
+		status, res := fn()
+		t.mu.Lock()
+		t.events = append(t.events, Event{Kind: EventFetch, Data: req, Response: res, Value: int64(status)})
+		t.mu.Unlock()
+		return status, res
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.next(&Event{Kind: EventFetch, Data: req}, func(e *Event) bool {
+		return bytes.Equal(e.Data, req)
+	})
+	if !ok {
+		return FetchFailed, nil
+	}
+	return uint32(e.Value), e.Response
+}
+
+// config records the result of fn, or returns the recorded one without
+// calling fn. Secrets are recorded and replayed as Redacted.
+func (t *tape) config(key string, fn func() (uint32, string, bool)) (uint32, string) {
+	if !t.replay {
+		status, value, secret := fn()
+		recorded := value
+		if secret && status == ConfigOK {
+			recorded = Redacted
+		}
+		t.mu.Lock()
+		t.events = append(t.events, Event{Kind: EventConfig, Data: []byte(key), Response: []byte(recorded), Value: int64(status)})
+		t.mu.Unlock()
+		return status, value
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.next(&Event{Kind: EventConfig, Data: []byte(key)}, func(e *Event) bool {
+		return string(e.Data) == key
+	})
+	if !ok {
+		return ConfigNotFound, ""
+	}
+	return uint32(e.Value), string(e.Response)
+}
+
+func (t *tape) walltime() (int64, int32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.replay {
+		sec, nsec := t.clock.walltime()
+		t.events = append(t.events, Event{Kind: EventWalltime, Value: sec, Nsec: nsec})
+		return sec, nsec
+	}
+	e, ok := t.next(&Event{Kind: EventWalltime}, nil)
+	if !ok {
+		return 0, 0
+	}
+	return e.Value, e.Nsec
+}
+
+func (t *tape) nanotime() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.replay {
+		n := t.clock.nanotime()
+		t.events = append(t.events, Event{Kind: EventNanotime, Value: n})
+		return n
+	}
+	e, ok := t.next(&Event{Kind: EventNanotime}, nil)
+	if !ok {
+		return 0
+	}
+	return e.Value
+}
+
+// Read implements the random source of the guest.
+func (t *tape) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.replay {
+		n, err := t.rand.Read(p)
+		t.events = append(t.events, Event{Kind: EventRandom, Data: bytes.Clone(p[:n])})
+		return n, err
+	}
+	e, ok := t.next(&Event{Kind: EventRandom, Data: make([]byte, len(p))}, func(e *Event) bool {
+		return len(e.Data) == len(p)
+	})
+	if !ok {
+		return 0, ErrReplayDiverged
+	}
+	return copy(p, e.Data), nil
+}
+
+func (t *tape) moduleConfig(cfg wazero.ModuleConfig) wazero.ModuleConfig {
+	return cfg.WithWalltime(t.walltime, sys.ClockResolution(1)).
+		WithNanotime(t.nanotime, sys.ClockResolution(1)).
+		WithRandSource(t)
+}
+
+// recording returns the recording of the last execution.
+func (f *Module) recording(init []Event, data string, errno uint64, res string, err error) *Recording {
+	r := &Recording{
+		Name:     f.config.Name,
+		Version:  f.config.Version,
+		Hash:     f.hash,
+		MainFunc: f.mainFuncName,
+		Mode:     f.config.Mode,
+		Init:     f.redactEvents(init),
+		Input:    f.redact(data),
+		Events:   f.redactEvents(f.tape.recorded()),
+		Errno:    errno,
+		Output:   f.redact(res),
+	}
+	if err != nil {
+		r.Error = f.redact(err.Error())
+	}
+	return r
+}
+
+// redactEvents returns a copy of events without the secrets resolved so far,
+// e.g. in the header of a fetch. A replay matches them, as the guest receives
+// Redacted as the value of the secrets. Random bytes are kept.
+func (f *Module) redactEvents(events []Event) []Event {
+	if len(f.secrets) == 0 {
+		return events
+	}
+	res := make([]Event, len(events))
+	for i, e := range events {
+		if e.Kind != EventRandom {
+			e.Data = f.redactBytes(e.Data)
+		}
+		e.Response = f.redactBytes(e.Response)
+		e.Error = f.redact(e.Error)
+		res[i] = e
+	}
+	return res
+}
+
+func (f *Module) record(ctx context.Context, r *Recording) {
+	if err := f.config.Recorder(ctx, r); err != nil {
+		zerolog.Ctx(ctx).Warn().AnErr("err", err).Msg("error saving recording")
+	}
+}
+
+func withTape(t *tape) ModuleOption {
+	return func(c *ModuleConfig) {
+		c.tape = t
+	}
+}
@@ -0,0 +1,129 @@
+package wasm_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	_ "embed"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrescosta/goico/pkg/runtimes/wasm"
+	"github.com/andrescosta/goico/pkg/test"
+)
+
+//go:embed testdata/replay.wasm
+var replayw []byte
+
+func TestRecordReplay(t *testing.T) {
+	ctx := context.Background()
+	runtime := wasm.NewInterpreterRuntime()
+	defer func() {
+		err := runtime.Close(ctx)
+		test.Nil(t, err)
+	}()
+	dir := t.TempDir()
+	var recs []*wasm.Recording
+	m, err := wasm.NewModule(ctx, runtime, replayw, "event", log,
+		wasm.WithName("replay"),
+		wasm.WithRandSource(rand.Reader),
+		wasm.WithRecorder(func(ctx context.Context, r *wasm.Recording) error {
+			recs = append(recs, r)
+			return wasm.RecordToDir(dir)(ctx, r)
+		}))
+	test.Nil(t, err)
+	defer m.Close(ctx)
+	var emitted [][]byte
+	_, res1, err := m.RunStream(ctx, "first", func(_ context.Context, b []byte) error {
+		emitted = append(emitted, b)
+		return nil
+	})
+	test.Nil(t, err)
+	_, res2, err := m.Run(ctx, "second")
+	test.Nil(t, err)
+	test.Len(t, recs, 2)
+	test.Len(t, emitted, 1)
+
+	files, err := filepath.Glob(filepath.Join(dir, "replay-*.replay.json"))
+	test.Nil(t, err)
+	test.Len(t, files, 2)
+	rec, err := wasm.ReadRecording(files[0])
+	test.Nil(t, err)
+	test.Equals(t, rec.Hash, wasm.Hash(replayw))
+
+	first, second := recs[0], recs[1]
+	test.Equals(t, first.Input, "first")
+	test.Equals(t, first.Output, res1)
+	test.Equals(t, second.Output, res2)
+	kinds := func(events []wasm.Event) []wasm.EventKind {
+		var ks []wasm.EventKind
+		for _, e := range events {
+			ks = append(ks, e.Kind)
+		}
+		return ks
+	}
+	test.Equals(t, kinds(first.Events), []wasm.EventKind{wasm.EventLog, wasm.EventEmit, wasm.EventWalltime, wasm.EventRandom})
+	test.Equals(t, first.Events[1].Value, int64(0))
+	test.Equals(t, second.Events[1].Value, int64(1))
+
+	t.Run("replay", func(t *testing.T) {
+		for _, r := range recs {
+			err := wasm.Replay(ctx, runtime, replayw, r)
+			test.Nil(t, err)
+		}
+	})
+	t.Run("divergent_input", func(t *testing.T) {
+		r := *first
+		r.Input = "other"
+		err := wasm.Replay(ctx, runtime, replayw, &r)
+		test.ErrorIs(t, err, wasm.ErrReplayDiverged)
+		var d *wasm.DivergenceError
+		if !errors.As(err, &d) {
+			t.Fatalf("expected DivergenceError got %v", err)
+		}
+		test.Equals(t, d.Index, 0)
+		test.Equals(t, d.Expected.Kind, wasm.EventLog)
+		test.Equals(t, string(d.Actual.Data), "other")
+	})
+	t.Run("missing_event", func(t *testing.T) {
+		r := *first
+		r.Events = r.Events[:2]
+		var d *wasm.DivergenceError
+		if !errors.As(wasm.Replay(ctx, runtime, replayw, &r), &d) {
+			t.Fatal("expected DivergenceError")
+		}
+		test.Equals(t, d.Index, 2)
+		test.Equals(t, d.Actual.Kind, wasm.EventWalltime)
+		if d.Expected != nil {
+			t.Errorf("expected no recorded event got %s", d.Expected)
+		}
+	})
+	t.Run("divergent_result", func(t *testing.T) {
+		r := *first
+		r.Output = "changed"
+		var d *wasm.DivergenceError
+		if !errors.As(wasm.Replay(ctx, runtime, replayw, &r), &d) {
+			t.Fatal("expected DivergenceError")
+		}
+		test.Equals(t, d.Actual.Kind, wasm.EventResult)
+		if !bytes.Equal(d.Actual.Data, []byte(res1)) {
+			t.Errorf("expected %v got %v", []byte(res1), d.Actual.Data)
+		}
+	})
+	t.Run("module_mismatch", func(t *testing.T) {
+		err := wasm.Replay(ctx, runtime, echo, first)
+		test.ErrorIs(t, err, wasm.ErrReplayModuleMismatch)
+	})
+	t.Run("recorder_error", func(t *testing.T) {
+		m, err := wasm.NewModule(ctx, runtime, replayw, "event", log,
+			wasm.WithRecorder(wasm.RecordToDir(filepath.Join(dir, "missing"))))
+		test.Nil(t, err)
+		defer m.Close(ctx)
+		_, _, err = m.Run(ctx, "in")
+		test.Nil(t, err)
+		_, err = os.Stat(filepath.Join(dir, "missing"))
+		test.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
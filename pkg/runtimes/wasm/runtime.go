@@ -9,41 +9,72 @@ import (
 )
 
 type Runtime struct {
-	cacheDir      *string
-	cache         wazero.CompilationCache
-	runtimeConfig wazero.RuntimeConfig
+	cacheDir       *string
+	cache          *compilationCache
+	runtimeConfig  wazero.RuntimeConfig
+	persistent     bool
+	maxCacheSize   int64
+	interpreter    bool
+	maxMemoryPages uint32
 }
 
-func NewRuntimeWithCompilationCache(tempDir string) (*Runtime, error) {
+type RuntimeOption func(*Runtime)
+
+// NewRuntime returns a runtime without compilation cache.
+func NewRuntime(opts ...RuntimeOption) *Runtime {
+	r := &Runtime{}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.runtimeConfig = r.newRuntimeConfig()
+	return r
+}
+
+// NewRuntimeWithCompilationCache returns a runtime that caches the compiled
+// modules in a temporary directory created in tempDir and removed by Close.
+// With WithPersistentCache the cache is stored in tempDir itself and
+// survives restarts.
+func NewRuntimeWithCompilationCache(tempDir string, opts ...RuntimeOption) (*Runtime, error) {
 	if tempDir == "" {
 		return nil, errors.New("directory cannot be empty")
 	}
+	r := &Runtime{}
+	for _, opt := range opts {
+		opt(r)
+	}
 	if err := os.MkdirAll(tempDir, 0o700); err != nil {
 		return nil, err
 	}
-	cacheDir, err := os.MkdirTemp(tempDir, "cache")
-	if err != nil {
-		return nil, err
+	cacheDir := tempDir
+	if !r.persistent {
+		var err error
+		cacheDir, err = os.MkdirTemp(tempDir, "cache")
+		if err != nil {
+			return nil, err
+		}
+		r.cacheDir = &cacheDir
 	}
-	cache, err := wazero.NewCompilationCacheWithDir(cacheDir)
-	if err != nil {
-		err := os.RemoveAll(cacheDir)
-		return nil, err
+	r.cache = newCompilationCache(cacheDir, r.maxCacheSize)
+	r.runtimeConfig = r.newRuntimeConfig()
+	return r, nil
+}
+
+func (r *Runtime) newRuntimeConfig() wazero.RuntimeConfig {
+	config := wazero.NewRuntimeConfig()
+	if r.interpreter {
+		config = wazero.NewRuntimeConfigInterpreter()
+	}
+	config = config.WithCloseOnContextDone(true)
+	if r.maxMemoryPages > 0 {
+		config = config.WithMemoryLimitPages(r.maxMemoryPages)
 	}
-	runtimeConfig := wazero.NewRuntimeConfig().
-		WithCompilationCache(cache).
-		WithCloseOnContextDone(true)
-	return &Runtime{
-		cacheDir:      &cacheDir,
-		cache:         cache,
-		runtimeConfig: runtimeConfig,
-	}, nil
+	return config
 }
 
 func (r *Runtime) Close(ctx context.Context) error {
 	var errs error
 	if r.cache != nil {
-		if err := r.cache.Close(ctx); err != nil {
+		if err := r.cache.close(ctx); err != nil {
 			errs = errors.Join(errs, err)
 		}
 	}
@@ -54,3 +85,34 @@ func (r *Runtime) Close(ctx context.Context) error {
 	}
 	return errs
 }
+
+// Setters
+func WithPersistentCache() RuntimeOption {
+	return func(r *Runtime) {
+		r.persistent = true
+	}
+}
+
+// WithInterpreter runs the modules with the interpreter instead of the
+// compiler, for platforms the compiler does not support. The compilation
+// cache is not used by the interpreter.
+func WithInterpreter() RuntimeOption {
+	return func(r *Runtime) {
+		r.interpreter = true
+	}
+}
+
+// WithMaxCacheSize bounds the size in bytes of the compilation cache. The
+// least recently used modules are evicted when it is exceeded.
+func WithMaxCacheSize(size int64) RuntimeOption {
+	return func(r *Runtime) {
+		r.maxCacheSize = size
+	}
+}
+
+// WithMemoryLimitPages limits the memory of every instance to pages of 64 KiB.
+func WithMemoryLimitPages(pages uint32) RuntimeOption {
+	return func(r *Runtime) {
+		r.maxMemoryPages = pages
+	}
+}
@@ -0,0 +1,325 @@
+package wasm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/andrescosta/goico/pkg/service/obs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var (
+	ErrQueueFull       = errors.New("scheduler queue is full")
+	ErrSchedulerClosed = errors.New("scheduler is closed")
+	ErrNoPool          = errors.New("task has no pool")
+	ErrPriority        = errors.New("task priority out of range")
+)
+
+type Priority uint32
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+	priorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// Task is an invocation of the module of Pool.
+type Task struct {
+	Pool     *Pool
+	Tenant   string
+	Priority Priority
+	Data     string
+	// Emit receives the emitted payloads. It can be nil.
+	Emit EmitFn
+}
+
+type SchedulerOption func(*Scheduler)
+
+// Scheduler runs tasks with a fixed number of workers. Pending tasks wait in
+// a bounded queue, where higher priorities go first and tenants of the same
+// priority take turns, so a busy tenant does not delay the others.
+type Scheduler struct {
+	workers      int
+	queueSize    int
+	otelProvider *obs.OtelProvider
+	telemetry    *schedulerTelemetry
+	mu           sync.Mutex
+	cond         *sync.Cond
+	levels       [priorities]level
+	depth        int
+	closed       bool
+	wg           sync.WaitGroup
+}
+
+// level are the tasks of a priority, queued by tenant. turns are the tenants
+// with pending tasks, in the order they are served.
+type level struct {
+	tenants map[string][]*job
+	turns   []string
+}
+
+type job struct {
+	ctx      context.Context
+	task     Task
+	queuedAt time.Time
+	done     chan result
+}
+
+type result struct {
+	errno uint64
+	res   string
+	err   error
+}
+
+type schedulerTelemetry struct {
+	depth    metric.Int64UpDownCounter
+	wait     metric.Float64Histogram
+	rejected metric.Int64Counter
+}
+
+// NewScheduler starts workers workers. At most queueSize tasks wait for a
+// worker, the rest are rejected with ErrQueueFull.
+func NewScheduler(workers, queueSize int, opts ...SchedulerOption) (*Scheduler, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 1 {
+		queueSize = workers
+	}
+	s := &Scheduler{
+		workers:   workers,
+		queueSize: queueSize,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	t, err := newSchedulerTelemetry(s.otelProvider)
+	if err != nil {
+		return nil, err
+	}
+	s.telemetry = t
+	s.cond = sync.NewCond(&s.mu)
+	for i := range s.levels {
+		s.levels[i].tenants = make(map[string][]*job)
+	}
+	s.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	return s, nil
+}
+
+func newSchedulerTelemetry(provider *obs.OtelProvider) (*schedulerTelemetry, error) {
+	meter := provider.Meter(instrumentationName)
+	t := &schedulerTelemetry{}
+	var err, errs error
+	t.depth, err = meter.Int64UpDownCounter("wasm.scheduler.queue.depth",
+		metric.WithDescription("Tasks waiting for a worker."),
+		metric.WithUnit("{task}"))
+	errs = errors.Join(errs, err)
+	t.wait, err = meter.Float64Histogram("wasm.scheduler.wait.duration",
+		metric.WithDescription("Time tasks waited for a worker."),
+		metric.WithUnit("s"))
+	errs = errors.Join(errs, err)
+	t.rejected, err = meter.Int64Counter("wasm.scheduler.rejected",
+		metric.WithDescription("Tasks rejected because the queue was full."))
+	errs = errors.Join(errs, err)
+	if errs != nil {
+		return nil, errs
+	}
+	return t, nil
+}
+
+// Run queues the task and waits for its result. It returns ErrQueueFull
+// without waiting when the queue is full. If ctx is done while the task is
+// queued, the task is dropped.
+func (s *Scheduler) Run(ctx context.Context, task Task) (uint64, string, error) {
+	if task.Pool == nil {
+		return 0, "", ErrNoPool
+	}
+	if task.Priority >= priorities {
+		return 0, "", ErrPriority
+	}
+	j := &job{
+		ctx:      ctx,
+		task:     task,
+		queuedAt: time.Now(),
+		done:     make(chan result, 1),
+	}
+	if err := s.push(ctx, j); err != nil {
+		return 0, "", err
+	}
+	select {
+	case r := <-j.done:
+		return r.errno, r.res, r.err
+	case <-ctx.Done():
+		if s.remove(j) {
+			return 0, "", ctx.Err()
+		}
+		// a worker has it, the module stops with ctx
+		r := <-j.done
+		return r.errno, r.res, r.err
+	}
+}
+
+// QueueDepth returns the number of tasks waiting for a worker.
+func (s *Scheduler) QueueDepth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.depth
+}
+
+// Close rejects the queued tasks and waits for the running ones.
+func (s *Scheduler) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrSchedulerClosed
+	}
+	s.closed = true
+	for i := range s.levels {
+		l := &s.levels[i]
+		for _, tenant := range l.turns {
+			for _, j := range l.tenants[tenant] {
+				s.dequeued(j)
+				j.done <- result{err: ErrSchedulerClosed}
+			}
+			delete(l.tenants, tenant)
+		}
+		l.turns = nil
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Scheduler) push(ctx context.Context, j *job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSchedulerClosed
+	}
+	attrs := metric.WithAttributes(attribute.String("wasm.task.priority", j.task.Priority.String()))
+	if s.depth >= s.queueSize {
+		s.telemetry.rejected.Add(ctx, 1, attrs)
+		return ErrQueueFull
+	}
+	l := &s.levels[j.task.Priority]
+	q, ok := l.tenants[j.task.Tenant]
+	if !ok {
+		l.turns = append(l.turns, j.task.Tenant)
+	}
+	l.tenants[j.task.Tenant] = append(q, j)
+	s.depth++
+	s.telemetry.depth.Add(ctx, 1, attrs)
+	s.cond.Signal()
+	return nil
+}
+
+// pop returns the next task, waiting until there is one. It returns nil when
+// the scheduler is closed.
+func (s *Scheduler) pop() *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if s.closed {
+			return nil
+		}
+		for p := priorities - 1; ; p-- {
+			l := &s.levels[p]
+			if len(l.turns) > 0 {
+				tenant := l.turns[0]
+				l.turns = l.turns[1:]
+				q := l.tenants[tenant]
+				j := q[0]
+				if len(q) > 1 {
+					l.tenants[tenant] = q[1:]
+					// the tenant waits for the others before its next task
+					l.turns = append(l.turns, tenant)
+				} else {
+					delete(l.tenants, tenant)
+				}
+				s.dequeued(j)
+				return j
+			}
+			if p == 0 {
+				break
+			}
+		}
+		s.cond.Wait()
+	}
+}
+
+// remove drops a queued task. It returns false if the task is not queued.
+func (s *Scheduler) remove(j *job) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := &s.levels[j.task.Priority]
+	q := l.tenants[j.task.Tenant]
+	for i, qj := range q {
+		if qj != j {
+			continue
+		}
+		q = append(q[:i:i], q[i+1:]...)
+		if len(q) > 0 {
+			l.tenants[j.task.Tenant] = q
+		} else {
+			delete(l.tenants, j.task.Tenant)
+			for t, tenant := range l.turns {
+				if tenant == j.task.Tenant {
+					l.turns = append(l.turns[:t:t], l.turns[t+1:]...)
+					break
+				}
+			}
+		}
+		s.dequeued(j)
+		return true
+	}
+	return false
+}
+
+func (s *Scheduler) dequeued(j *job) {
+	attrs := metric.WithAttributes(attribute.String("wasm.task.priority", j.task.Priority.String()))
+	s.depth--
+	s.telemetry.depth.Add(j.ctx, -1, attrs)
+	s.telemetry.wait.Record(j.ctx, time.Since(j.queuedAt).Seconds(), attrs)
+}
+
+func (s *Scheduler) work() {
+	defer s.wg.Done()
+	for {
+		j := s.pop()
+		if j == nil {
+			return
+		}
+		if err := j.ctx.Err(); err != nil {
+			j.done <- result{err: err}
+			continue
+		}
+		errno, res, err := j.task.Pool.RunStream(j.ctx, j.task.Data, j.task.Emit)
+		j.done <- result{errno: errno, res: res, err: err}
+	}
+}
+
+// Setters
+func WithSchedulerOtelProvider(p *obs.OtelProvider) SchedulerOption {
+	return func(s *Scheduler) {
+		s.otelProvider = p
+	}
+}
@@ -0,0 +1,178 @@
+package wasm_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andrescosta/goico/pkg/runtimes/wasm"
+	"github.com/andrescosta/goico/pkg/service/obs"
+	"github.com/andrescosta/goico/pkg/test"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestScheduler(t *testing.T) {
+	ctx := context.Background()
+	runtime := wasm.NewInterpreterRuntime()
+	defer runtime.Close(ctx)
+	pool, err := wasm.NewPool(ctx, runtime, streamw, "event", log, 2)
+	test.Nil(t, err)
+	defer pool.Close(ctx)
+
+	// blocked returns a task that runs until release is closed.
+	blocked := func(release chan struct{}, running chan struct{}) wasm.Task {
+		return wasm.Task{Pool: pool, Tenant: "blocker", Data: "x", Emit: func(ctx context.Context, _ []byte) error {
+			close(running)
+			select {
+			case <-release:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}}
+	}
+	waitDepth := func(t *testing.T, s *wasm.Scheduler, depth int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for s.QueueDepth() != depth {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected depth %d got %d", depth, s.QueueDepth())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	t.Run("order", func(t *testing.T) {
+		s, err := wasm.NewScheduler(1, 10)
+		test.Nil(t, err)
+		defer s.Close()
+		release, running := make(chan struct{}), make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := s.Run(ctx, blocked(release, running)); err != nil {
+				t.Errorf("expected <nil> got %v", err)
+			}
+		}()
+		<-running
+		var mu sync.Mutex
+		var order []string
+		submit := func(tenant string, p wasm.Priority, data string, depth int) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, res, err := s.Run(ctx, wasm.Task{Pool: pool, Tenant: tenant, Priority: p, Data: data, Emit: func(context.Context, []byte) error {
+					mu.Lock()
+					defer mu.Unlock()
+					order = append(order, data)
+					return nil
+				}})
+				if err != nil || res != data {
+					t.Errorf("expected %s got %s, %v", data, res, err)
+				}
+			}()
+			waitDepth(t, s, depth)
+		}
+		submit("a", wasm.PriorityNormal, "a1", 1)
+		submit("a", wasm.PriorityNormal, "a2", 2)
+		submit("a", wasm.PriorityNormal, "a3", 3)
+		submit("b", wasm.PriorityNormal, "b1", 4)
+		submit("c", wasm.PriorityLow, "c1", 5)
+		submit("b", wasm.PriorityHigh, "h1", 6)
+		close(release)
+		wg.Wait()
+		test.Equals(t, order, []string{"h1", "a1", "b1", "a2", "a3", "c1"})
+	})
+	t.Run("queue_full", func(t *testing.T) {
+		reader := metric.NewManualReader()
+		provider := obs.NewWithProviders(sdktrace.NewTracerProvider(), metric.NewMeterProvider(metric.WithReader(reader)))
+		s, err := wasm.NewScheduler(1, 1, wasm.WithSchedulerOtelProvider(provider))
+		test.Nil(t, err)
+		defer s.Close()
+		release, running := make(chan struct{}), make(chan struct{})
+		go func() {
+			_, _, _ = s.Run(ctx, blocked(release, running))
+		}()
+		<-running
+		done := make(chan error)
+		go func() {
+			_, _, err := s.Run(ctx, wasm.Task{Pool: pool, Data: "q"})
+			done <- err
+		}()
+		waitDepth(t, s, 1)
+		_, _, err = s.Run(ctx, wasm.Task{Pool: pool, Data: "rejected"})
+		test.ErrorIs(t, err, wasm.ErrQueueFull)
+		_, _, err = s.Run(ctx, wasm.Task{Data: "no pool"})
+		test.ErrorIs(t, err, wasm.ErrNoPool)
+		_, _, err = s.Run(ctx, wasm.Task{Pool: pool, Priority: wasm.PriorityHigh + 1})
+		test.ErrorIs(t, err, wasm.ErrPriority)
+		close(release)
+		test.Nil(t, <-done)
+
+		var rm metricdata.ResourceMetrics
+		err = reader.Collect(ctx, &rm)
+		test.Nil(t, err)
+		values := make(map[string]int64)
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				switch d := m.Data.(type) {
+				case metricdata.Histogram[float64]:
+					for _, p := range d.DataPoints {
+						values[m.Name] += int64(p.Count)
+					}
+				case metricdata.Sum[int64]:
+					for _, p := range d.DataPoints {
+						values[m.Name] += p.Value
+					}
+				}
+			}
+		}
+		test.Equals(t, values["wasm.scheduler.wait.duration"], int64(2))
+		test.Equals(t, values["wasm.scheduler.queue.depth"], int64(0))
+		test.Equals(t, values["wasm.scheduler.rejected"], int64(1))
+	})
+	t.Run("canceled", func(t *testing.T) {
+		s, err := wasm.NewScheduler(1, 1)
+		test.Nil(t, err)
+		defer s.Close()
+		release, running := make(chan struct{}), make(chan struct{})
+		defer close(release)
+		go func() {
+			_, _, _ = s.Run(ctx, blocked(release, running))
+		}()
+		<-running
+		ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		_, _, err = s.Run(ctx, wasm.Task{Pool: pool, Data: "q"})
+		test.ErrorIs(t, err, context.DeadlineExceeded)
+		test.Equals(t, s.QueueDepth(), 0)
+	})
+	t.Run("closed", func(t *testing.T) {
+		s, err := wasm.NewScheduler(1, 1)
+		test.Nil(t, err)
+		release, running := make(chan struct{}), make(chan struct{})
+		go func() {
+			_, _, _ = s.Run(ctx, blocked(release, running))
+		}()
+		<-running
+		done := make(chan error)
+		go func() {
+			_, _, err := s.Run(ctx, wasm.Task{Pool: pool, Data: "q"})
+			done <- err
+		}()
+		waitDepth(t, s, 1)
+		closed := make(chan error)
+		go func() {
+			closed <- s.Close()
+		}()
+		test.ErrorIs(t, <-done, wasm.ErrSchedulerClosed)
+		close(release)
+		test.Nil(t, <-closed)
+		_, _, err = s.Run(ctx, wasm.Task{Pool: pool, Data: "q"})
+		test.ErrorIs(t, err, wasm.ErrSchedulerClosed)
+	})
+}
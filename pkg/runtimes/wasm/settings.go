@@ -0,0 +1,128 @@
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/tetratelabs/wazero/api"
+)
+
+var ErrNoSecretProvider = errors.New("no secret provider configured")
+
+// Values returned to the guest by config_get.
+const (
+	ConfigOK uint32 = iota
+	ConfigNotFound
+	// ConfigFailed is returned when a secret could not be resolved.
+	ConfigFailed
+)
+
+// Redacted replaces the secrets in the logs of the guest and in the
+// recordings.
+const Redacted = "[REDACTED]"
+
+// SecretProvider resolves the references of the secrets, e.g. the name of a
+// secret in a vault.
+type SecretProvider interface {
+	Secret(ctx context.Context, ref string) (string, error)
+}
+
+// SecretFunc is a SecretProvider function.
+type SecretFunc func(ctx context.Context, ref string) (string, error)
+
+func (f SecretFunc) Secret(ctx context.Context, ref string) (string, error) {
+	return f(ctx, ref)
+}
+
+// Setting is a configuration value of the module. The value of a secret is
+// the reference resolved by the SecretProvider.
+type Setting struct {
+	Value  string
+	Secret bool
+}
+
+// configGet is the config_get host function. The guest calls
+//
+//	config_get(key_ptr, key_len, res_ptr) -> status
+//
+// When status is ConfigOK, the host writes the pointer and length of the
+// value, allocated with the malloc export of the guest, at res_ptr as two
+// little endian uint32. The guest must free it.
+func (f *Module) configGet(ctx context.Context, m api.Module, offset, byteCount, resOffset uint32) uint32 {
+	buf, ok := m.Memory().Read(offset, byteCount)
+	if !ok {
+		panic(fmt.Errorf("Memory.Read(%d, %d) out of range", offset, byteCount))
+	}
+	key := string(buf)
+	var (
+		status uint32
+		value  string
+	)
+	if f.tape != nil {
+		status, value = f.tape.config(key, func() (uint32, string, bool) {
+			status, value := f.setting(ctx, key)
+			return status, value, f.config.Settings[key].Secret
+		})
+	} else {
+		status, value = f.setting(ctx, key)
+	}
+	if status != ConfigOK {
+		return status
+	}
+	if err := writeToGuest(ctx, m, resOffset, []byte(value)); err != nil {
+		panic(err)
+	}
+	return ConfigOK
+}
+
+// setting returns the value of key, resolving it when it is a secret. Secrets
+// are resolved once per module.
+func (f *Module) setting(ctx context.Context, key string) (uint32, string) {
+	s, ok := f.config.Settings[key]
+	if !ok {
+		return ConfigNotFound, ""
+	}
+	if !s.Secret {
+		return ConfigOK, s.Value
+	}
+	if v, ok := f.secrets[key]; ok {
+		return ConfigOK, v
+	}
+	if f.config.Secrets == nil {
+		zerolog.Ctx(ctx).Error().Err(ErrNoSecretProvider).Str("key", key).Msg("config_get: error resolving secret")
+		return ConfigFailed, ""
+	}
+	v, err := f.config.Secrets.Secret(ctx, s.Value)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Str("key", key).Msg("config_get: error resolving secret")
+		return ConfigFailed, ""
+	}
+	if f.secrets == nil {
+		f.secrets = make(map[string]string)
+	}
+	f.secrets[key] = v
+	return ConfigOK, v
+}
+
+// redact replaces the secrets resolved so far in msg.
+func (f *Module) redact(msg string) string {
+	for _, v := range f.secrets {
+		if v != "" {
+			msg = strings.ReplaceAll(msg, v, Redacted)
+		}
+	}
+	return msg
+}
+
+func (f *Module) redactBytes(b []byte) []byte {
+	for _, v := range f.secrets {
+		if v != "" {
+			b = bytes.ReplaceAll(b, []byte(v), []byte(Redacted))
+		}
+	}
+	return b
+}
@@ -0,0 +1,108 @@
+package wasm_test
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/andrescosta/goico/pkg/runtimes/wasm"
+	"github.com/andrescosta/goico/pkg/test"
+)
+
+//go:embed testdata/config.wasm
+var configw []byte
+
+func TestSettings(t *testing.T) {
+	ctx := context.Background()
+	runtime := wasm.NewInterpreterRuntime()
+	defer func() {
+		err := runtime.Close(ctx)
+		test.Nil(t, err)
+	}()
+	var logs []string
+	logFn := func(_ context.Context, _ uint32, msg string) error {
+		logs = append(logs, msg)
+		return nil
+	}
+	resolved := 0
+	secrets := wasm.SecretFunc(func(_ context.Context, ref string) (string, error) {
+		switch ref {
+		case "vault/db":
+			resolved++
+			return "s3cr3t", nil
+		default:
+			return "", errors.New("unknown secret")
+		}
+	})
+	var recs []*wasm.Recording
+	m, err := wasm.NewModule(ctx, runtime, configw, "event", logFn,
+		wasm.WithSettings(map[string]string{"region": "us-east"}),
+		wasm.WithSecret("password", "vault/db"),
+		wasm.WithSecret("token", "vault/missing"),
+		wasm.WithSecretProvider(secrets),
+		wasm.WithRecorder(func(_ context.Context, r *wasm.Recording) error {
+			recs = append(recs, r)
+			return nil
+		}))
+	test.Nil(t, err)
+	defer m.Close(ctx)
+
+	errno, res, err := m.Run(ctx, "region")
+	test.Nil(t, err)
+	test.Equals(t, errno, uint64(wasm.ConfigOK))
+	test.Equals(t, res, "us-east")
+
+	for i := 0; i < 2; i++ {
+		errno, res, err = m.Run(ctx, "password")
+		test.Nil(t, err)
+		test.Equals(t, errno, uint64(wasm.ConfigOK))
+		test.Equals(t, res, "s3cr3t")
+	}
+	test.Equals(t, resolved, 1)
+	test.Equals(t, logs, []string{"us-east", wasm.Redacted, wasm.Redacted})
+
+	errno, _, err = m.Run(ctx, "missing")
+	test.Nil(t, err)
+	test.Equals(t, errno, uint64(wasm.ConfigNotFound))
+	errno, _, err = m.Run(ctx, "token")
+	test.Nil(t, err)
+	test.Equals(t, errno, uint64(wasm.ConfigFailed))
+	errno, _, err = m.Run(ctx, "s3cr3t")
+	test.Nil(t, err)
+	test.Equals(t, errno, uint64(wasm.ConfigNotFound))
+
+	t.Run("recording", func(t *testing.T) {
+		test.Len(t, recs, 6)
+		rec := recs[1]
+		test.Equals(t, rec.Events[0].Kind, wasm.EventConfig)
+		test.Equals(t, string(rec.Events[0].Response), wasm.Redacted)
+		test.Equals(t, rec.Output, wasm.Redacted)
+		test.Equals(t, recs[5].Input, wasm.Redacted)
+		for _, r := range recs {
+			j, err := json.Marshal(r)
+			test.Nil(t, err)
+			test.Equals(t, bytes.Contains(j, []byte("s3cr3t")), false)
+			err = wasm.Replay(ctx, runtime, configw, r)
+			test.Nil(t, err)
+		}
+	})
+}
+
+func TestSettingsNoProvider(t *testing.T) {
+	ctx := context.Background()
+	runtime := wasm.NewInterpreterRuntime()
+	defer func() {
+		err := runtime.Close(ctx)
+		test.Nil(t, err)
+	}()
+	m, err := wasm.NewModule(ctx, runtime, configw, "event", log,
+		wasm.WithSecret("password", "vault/db"))
+	test.Nil(t, err)
+	defer m.Close(ctx)
+	errno, _, err := m.Run(ctx, "password")
+	test.Nil(t, err)
+	test.Equals(t, errno, uint64(wasm.ConfigFailed))
+}
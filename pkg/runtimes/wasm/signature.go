@@ -0,0 +1,136 @@
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+)
+
+// SignatureSection is the name of the custom section that holds an embedded
+// signature.
+const SignatureSection = "goico.signature"
+
+var (
+	ErrUnsigned         = errors.New("module is not signed")
+	ErrInvalidSignature = errors.New("module signature is not valid")
+	ErrNoTrustedKeys    = errors.New("no trusted keys configured")
+)
+
+var wasmHeader = []byte{0x00, 0x61, 0x73, 0x6d}
+
+// Verifier checks the signatures of modules against a set of trusted keys.
+type Verifier struct {
+	keys map[string]ed25519.PublicKey
+}
+
+// NewVerifier returns a Verifier that trusts keys, indexed by a name used in
+// the audit log.
+func NewVerifier(keys map[string]ed25519.PublicKey) *Verifier {
+	return &Verifier{keys: keys}
+}
+
+// Sign returns the detached signature of the module. Embedded signatures are
+// not signed, so a module can carry both.
+func Sign(wasmModule []byte, key ed25519.PrivateKey) ([]byte, error) {
+	content, _, err := splitSignature(wasmModule)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.Sign(key, content), nil
+}
+
+// Embed returns the module with its signature in a custom section, replacing
+// the embedded signature it had.
+func Embed(wasmModule []byte, key ed25519.PrivateKey) ([]byte, error) {
+	content, _, err := splitSignature(wasmModule)
+	if err != nil {
+		return nil, err
+	}
+	sig := ed25519.Sign(key, content)
+	name := binary.AppendUvarint(nil, uint64(len(SignatureSection)))
+	name = append(name, SignatureSection...)
+	signed := bytes.Clone(content)
+	signed = append(signed, 0)
+	signed = binary.AppendUvarint(signed, uint64(len(name)+len(sig)))
+	signed = append(signed, name...)
+	return append(signed, sig...), nil
+}
+
+// Verify checks signature, or the embedded signature when it is nil, against
+// the trusted keys. Every verification is written to the audit log.
+func (v *Verifier) Verify(ctx context.Context, name string, wasmModule, signature []byte) error {
+	key, err := v.verify(wasmModule, signature)
+	e := zerolog.Ctx(ctx).Info()
+	if err != nil {
+		e = zerolog.Ctx(ctx).Warn().AnErr("err", err)
+	}
+	e.Bool("audit", true).
+		Str("module", name).
+		Str("hash", Hash(wasmModule)).
+		Str("key", key).
+		Bool("embedded", signature == nil).
+		Bool("accepted", err == nil).
+		Msg("module signature verification")
+	return err
+}
+
+func (v *Verifier) verify(wasmModule, signature []byte) (string, error) {
+	if len(v.keys) == 0 {
+		return "", ErrNoTrustedKeys
+	}
+	content, embedded, err := splitSignature(wasmModule)
+	if err != nil {
+		return "", err
+	}
+	if signature == nil {
+		signature = embedded
+	}
+	if signature == nil {
+		return "", ErrUnsigned
+	}
+	for name, key := range v.keys {
+		if ed25519.Verify(key, content, signature) {
+			return name, nil
+		}
+	}
+	return "", ErrInvalidSignature
+}
+
+// splitSignature returns the module without the signature sections and the
+// embedded signature.
+func splitSignature(wasmModule []byte) ([]byte, []byte, error) {
+	if len(wasmModule) < 8 || !bytes.Equal(wasmModule[:4], wasmHeader) {
+		return nil, nil, fmt.Errorf("%w: invalid header", ErrInvalidModule)
+	}
+	content := make([]byte, 0, len(wasmModule))
+	content = append(content, wasmModule[:8]...)
+	var sig []byte
+	r := wasmModule[8:]
+	for len(r) > 0 {
+		id := r[0]
+		size, n := binary.Uvarint(r[1:])
+		if n <= 0 || uint64(len(r)-1-n) < size {
+			return nil, nil, fmt.Errorf("%w: invalid section", ErrInvalidModule)
+		}
+		end := 1 + n + int(size)
+		section, payload := r[:end], r[1+n:end]
+		r = r[end:]
+		if id == 0 {
+			nameLen, m := binary.Uvarint(payload)
+			if m <= 0 || uint64(len(payload)-m) < nameLen {
+				return nil, nil, fmt.Errorf("%w: invalid custom section", ErrInvalidModule)
+			}
+			if string(payload[m:m+int(nameLen)]) == SignatureSection {
+				sig = payload[m+int(nameLen):]
+				continue
+			}
+		}
+		content = append(content, section...)
+	}
+	return content, sig, nil
+}
@@ -0,0 +1,113 @@
+package wasm_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andrescosta/goico/pkg/runtimes/wasm"
+	"github.com/andrescosta/goico/pkg/test"
+	"github.com/rs/zerolog"
+)
+
+func TestSignature(t *testing.T) {
+	ctx := context.Background()
+	runtime := wasm.NewInterpreterRuntime()
+	defer runtime.Close(ctx)
+	pub, priv, err := ed25519.GenerateKey(nil)
+	test.Nil(t, err)
+	_, untrusted, err := ed25519.GenerateKey(nil)
+	test.Nil(t, err)
+	verifier := wasm.NewVerifier(map[string]ed25519.PublicKey{"release": pub})
+
+	load := func(ctx context.Context, wasmModule []byte, opts ...wasm.ModuleOption) error {
+		opts = append(opts, wasm.WithVerifier(verifier))
+		m, err := wasm.NewModule(ctx, runtime, wasmModule, "event", log, opts...)
+		if err != nil {
+			return err
+		}
+		defer m.Close(ctx)
+		_, res, err := m.Run(ctx, "signed")
+		test.Nil(t, err)
+		test.Equals(t, res, "signed")
+		return nil
+	}
+	t.Run("detached", func(t *testing.T) {
+		sig, err := wasm.Sign(echo, priv)
+		test.Nil(t, err)
+		var out bytes.Buffer
+		ctx := zerolog.New(&out).WithContext(ctx)
+		err = load(ctx, echo, wasm.WithName("echo"), wasm.WithSignature(sig))
+		test.Nil(t, err)
+		if !strings.Contains(out.String(), `"audit":true`) || !strings.Contains(out.String(), `"key":"release"`) {
+			t.Errorf("expected audit entry got %s", out.String())
+		}
+	})
+	t.Run("embedded", func(t *testing.T) {
+		signed, err := wasm.Embed(echo, priv)
+		test.Nil(t, err)
+		err = load(ctx, signed)
+		test.Nil(t, err)
+		// signing again replaces the signature
+		resigned, err := wasm.Embed(signed, priv)
+		test.Nil(t, err)
+		test.Equals(t, len(resigned), len(signed))
+		sig, err := wasm.Sign(signed, priv)
+		test.Nil(t, err)
+		err = load(ctx, echo, wasm.WithSignature(sig))
+		test.Nil(t, err)
+	})
+	t.Run("unsigned", func(t *testing.T) {
+		var out bytes.Buffer
+		ctx := zerolog.New(&out).WithContext(ctx)
+		err := load(ctx, echo)
+		test.ErrorIs(t, err, wasm.ErrUnsigned)
+		if !strings.Contains(out.String(), `"accepted":false`) {
+			t.Errorf("expected audit entry got %s", out.String())
+		}
+	})
+	t.Run("tampered", func(t *testing.T) {
+		sig, err := wasm.Sign(echo, priv)
+		test.Nil(t, err)
+		err = load(ctx, doerror, wasm.WithSignature(sig))
+		test.ErrorIs(t, err, wasm.ErrInvalidSignature)
+		signed, err := wasm.Embed(echo, priv)
+		test.Nil(t, err)
+		tampered := bytes.Clone(signed)
+		tampered[len(echo)-1] ^= 0xff
+		err = load(ctx, tampered)
+		test.ErrorIs(t, err, wasm.ErrInvalidSignature)
+	})
+	t.Run("untrusted", func(t *testing.T) {
+		signed, err := wasm.Embed(echo, untrusted)
+		test.Nil(t, err)
+		err = load(ctx, signed)
+		test.ErrorIs(t, err, wasm.ErrInvalidSignature)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		_, err := wasm.Sign([]byte("not wasm"), priv)
+		test.ErrorIs(t, err, wasm.ErrInvalidModule)
+	})
+	t.Run("dir_source", func(t *testing.T) {
+		dir := t.TempDir()
+		sig, err := wasm.Sign(echo, priv)
+		test.Nil(t, err)
+		test.Nil(t, os.WriteFile(filepath.Join(dir, "signed.wasm"), echo, 0o600))
+		test.Nil(t, os.WriteFile(filepath.Join(dir, "signed.wasm.sig"), sig, 0o600))
+		test.Nil(t, os.WriteFile(filepath.Join(dir, "unsigned.wasm"), echo, 0o600))
+		m := wasm.NewManager(runtime, &wasm.DirSource{Dir: dir}, "event", log,
+			wasm.WithModuleOptions(wasm.WithVerifier(verifier)))
+		defer m.Close(ctx)
+		err = m.Reload(ctx)
+		test.ErrorIs(t, err, wasm.ErrUnsigned)
+		_, res, err := m.Run(ctx, "signed", "in")
+		test.Nil(t, err)
+		test.Equals(t, res, "in")
+		_, _, err = m.Run(ctx, "unsigned", "in")
+		test.ErrorIs(t, err, wasm.ErrModuleNotFound)
+	})
+}
@@ -0,0 +1,109 @@
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/tetratelabs/wazero/api"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrEmitLimit = errors.New("emitted bytes limit exceeded")
+
+// Values returned to the guest by emit.
+const (
+	emitOK uint32 = iota
+	// emitNoStream is returned when the module was executed with Run.
+	emitNoStream
+)
+
+// EmitFn receives the payloads emitted by the guest. The guest is blocked
+// until it returns, so slow receivers slow down the guest. Returning an error
+// aborts the execution.
+type EmitFn func(context.Context, []byte) error
+
+type streamKey struct{}
+
+type stream struct {
+	emit     EmitFn
+	maxBytes int64
+	bytes    int64
+	count    int64
+}
+
+// EmitTo returns an EmitFn that sends the payloads to ch. Sends block while
+// ch is full, until ctx is done.
+func EmitTo(ch chan<- []byte) EmitFn {
+	return func(ctx context.Context, b []byte) error {
+		select {
+		case ch <- b:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// RunStream executes the module like Run, delivering to emit every payload
+// the guest passes to the emit host function.
+func (f *Module) RunStream(ctx context.Context, data string, emit EmitFn) (uint64, string, error) {
+	s := &stream{
+		emit:     emit,
+		maxBytes: f.config.MaxEmitBytes,
+	}
+	ctx = context.WithValue(ctx, streamKey{}, s)
+	return f.Run(ctx, data)
+}
+
+// emitHost is the emit host function. Errors abort the execution.
+func (f *Module) emitHost(ctx context.Context, m api.Module, offset, byteCount uint32) uint32 {
+	var (
+		res uint32
+		err error
+	)
+	if f.tape != nil {
+		payload, ok := m.Memory().Read(offset, byteCount)
+		if !ok {
+			panic(fmt.Errorf("Memory.Read(%d, %d) out of range", offset, byteCount))
+		}
+		res, err = f.tape.emit(bytes.Clone(payload), func() (uint32, error) {
+			return f.emit(ctx, m, offset, byteCount)
+		})
+	} else {
+		res, err = f.emit(ctx, m, offset, byteCount)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// emit delivers the payload to the stream of the execution. The payload is
+// copied, since the guest memory can be reused once emit returns.
+func (f *Module) emit(ctx context.Context, m api.Module, offset, byteCount uint32) (uint32, error) {
+	s, ok := ctx.Value(streamKey{}).(*stream)
+	if !ok || s.emit == nil {
+		return emitNoStream, nil
+	}
+	if s.maxBytes > 0 && s.bytes+int64(byteCount) > s.maxBytes {
+		return 0, fmt.Errorf("%w: %d bytes", ErrEmitLimit, s.maxBytes)
+	}
+	buf, ok := m.Memory().Read(offset, byteCount)
+	if !ok {
+		return 0, fmt.Errorf("Memory.Read(%d, %d) out of range", offset, byteCount)
+	}
+	payload := make([]byte, len(buf))
+	copy(payload, buf)
+	if err := s.emit(ctx, payload); err != nil {
+		return 0, err
+	}
+	s.bytes += int64(byteCount)
+	s.count++
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Int64("wasm.emit.count", s.count),
+		attribute.Int64("wasm.emit.size", s.bytes))
+	return emitOK, nil
+}
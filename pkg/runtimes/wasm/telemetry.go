@@ -0,0 +1,155 @@
+package wasm
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/andrescosta/goico/pkg/service/obs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/andrescosta/goico/pkg/runtimes/wasm"
+
+const pageSize = 65536
+
+// telemetry holds the tracer and instruments of a module. When no provider is
+// configured they are no-ops.
+type telemetry struct {
+	tracer       trace.Tracer
+	latency      metric.Float64Histogram
+	errors       metric.Int64Counter
+	memoryPages  metric.Int64Histogram
+	memoryGrowth metric.Int64Histogram
+	recycles     metric.Int64Counter
+	compileTime  metric.Float64Histogram
+}
+
+func newTelemetry(provider *obs.OtelProvider) (*telemetry, error) {
+	meter := provider.Meter(instrumentationName)
+	t := &telemetry{
+		tracer: provider.Tracer(instrumentationName),
+	}
+	var err, errs error
+	t.latency, err = meter.Float64Histogram("wasm.invocation.duration",
+		metric.WithDescription("Duration of module invocations."),
+		metric.WithUnit("s"))
+	errs = errors.Join(errs, err)
+	t.errors, err = meter.Int64Counter("wasm.invocation.errors",
+		metric.WithDescription("Invocations that returned an errno or failed."))
+	errs = errors.Join(errs, err)
+	t.memoryPages, err = meter.Int64Histogram("wasm.memory.pages",
+		metric.WithDescription("Memory pages of the instance after an invocation."),
+		metric.WithUnit("{page}"))
+	errs = errors.Join(errs, err)
+	t.memoryGrowth, err = meter.Int64Histogram("wasm.memory.growth",
+		metric.WithDescription("Memory pages the instance grew in an invocation."),
+		metric.WithUnit("{page}"))
+	errs = errors.Join(errs, err)
+	t.recycles, err = meter.Int64Counter("wasm.instance.recycles",
+		metric.WithDescription("Instances recycled because their memory crossed the limits."))
+	errs = errors.Join(errs, err)
+	t.compileTime, err = meter.Float64Histogram("wasm.compile.duration",
+		metric.WithDescription("Duration of module compilations."),
+		metric.WithUnit("s"))
+	errs = errors.Join(errs, err)
+	if errs != nil {
+		return nil, errs
+	}
+	return t, nil
+}
+
+func (f *Module) attributes() []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("wasm.module.name", f.config.Name),
+		attribute.String("wasm.module.version", f.config.Version),
+		attribute.String("wasm.module.abi", f.abi()),
+	}
+	if f.config.Tenant != "" {
+		attrs = append(attrs, attribute.String("wasm.tenant", f.config.Tenant))
+	}
+	return attrs
+}
+
+func (f *Module) abi() string {
+	switch {
+	case f.config.Mode == ModeCommand:
+		return "command"
+	case f.ver == TypeRust:
+		return "rust"
+	default:
+		return "default"
+	}
+}
+
+func (f *Module) recordCompile(ctx context.Context, d time.Duration) {
+	attrs := []attribute.KeyValue{
+		attribute.String("wasm.module.name", f.config.Name),
+		attribute.String("wasm.module.version", f.config.Version),
+	}
+	if f.config.Tenant != "" {
+		attrs = append(attrs, attribute.String("wasm.tenant", f.config.Tenant))
+	}
+	f.telemetry.compileTime.Record(ctx, d.Seconds(), metric.WithAttributes(attrs...))
+}
+
+// startRun starts the span of an invocation. The returned function ends it
+// and records the invocation metrics.
+func (f *Module) startRun(ctx context.Context, data string) (context.Context, func(uint64, string, error)) {
+	attrs := f.attributes()
+	ctx, span := f.telemetry.tracer.Start(ctx, "wasm.run",
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(attrs...),
+		trace.WithAttributes(attribute.Int("wasm.input.size", len(data))))
+	start := time.Now()
+	return ctx, func(errno uint64, res string, err error) {
+		f.telemetry.latency.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(attrs...))
+		if f.module != nil {
+			f.telemetry.memoryPages.Record(ctx, int64(f.module.Memory().Size()/pageSize), metric.WithAttributes(attrs...))
+		}
+		switch {
+		case err != nil:
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			f.telemetry.errors.Add(ctx, 1, metric.WithAttributes(attrs...),
+				metric.WithAttributes(attribute.String("wasm.error.kind", errorKind(err))))
+		case errno != 0:
+			span.SetStatus(codes.Error, "errno "+strconv.FormatUint(errno, 10))
+			f.telemetry.errors.Add(ctx, 1, metric.WithAttributes(attrs...),
+				metric.WithAttributes(
+					attribute.String("wasm.error.kind", "errno"),
+					attribute.Int64("wasm.errno", int64(errno))))
+		}
+		span.SetAttributes(
+			attribute.Int64("wasm.errno", int64(errno)),
+			attribute.Int("wasm.output.size", len(res)))
+		span.End()
+	}
+}
+
+// errorKind classifies the errors returned by Run for the error counter.
+func errorKind(err error) string {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return KindHost.String()
+	}
+	if execErr.Kind == KindTrap {
+		return string(execErr.Trap)
+	}
+	return execErr.Kind.String()
+}
+
+// logEvent records a guest log call as an event of the current span.
+func logEvent(ctx context.Context, level uint32, msg string) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	span.AddEvent("log", trace.WithAttributes(
+		attribute.Int64("log.level", int64(level)),
+		attribute.String("log.message", msg)))
+}
@@ -0,0 +1,103 @@
+package wasm_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/andrescosta/goico/pkg/runtimes/wasm"
+	"github.com/andrescosta/goico/pkg/service/obs"
+	"github.com/andrescosta/goico/pkg/test"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTelemetry(t *testing.T) {
+	ctx := context.Background()
+	exporter := tracetest.NewInMemoryExporter()
+	reader := metric.NewManualReader()
+	provider := obs.NewWithProviders(
+		sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)),
+		metric.NewMeterProvider(metric.WithReader(reader)))
+	runtime := wasm.NewInterpreterRuntime()
+	defer runtime.Close(ctx)
+	opts := []wasm.ModuleOption{wasm.WithName("jobicolet"), wasm.WithVersion("v1"), wasm.WithOtelProvider(provider)}
+
+	logm, err := wasm.NewModule(ctx, runtime, logw, "event", log, opts...)
+	test.Nil(t, err)
+	defer logm.Close(ctx)
+	code, _, err := logm.Run(ctx, "log_ok_")
+	test.Nil(t, err)
+	test.Equals(t, code, uint64(0))
+	errm, err := wasm.NewModule(ctx, runtime, doerror, "event", log, opts...)
+	test.Nil(t, err)
+	defer errm.Close(ctx)
+	code, _, err = errm.Run(ctx, "test_error")
+	test.Nil(t, err)
+	test.Equals(t, code, uint64(500))
+
+	spans := exporter.GetSpans()
+	test.Len(t, spans, 2)
+	attrs := func(s tracetest.SpanStub) map[attribute.Key]attribute.Value {
+		m := make(map[attribute.Key]attribute.Value)
+		for _, a := range s.Attributes {
+			m[a.Key] = a.Value
+		}
+		return m
+	}
+	a := attrs(spans[0])
+	test.Equals(t, a["wasm.module.name"].AsString(), "jobicolet")
+	test.Equals(t, a["wasm.module.version"].AsString(), "v1")
+	test.Equals(t, a["wasm.module.abi"].AsString(), "default")
+	test.Equals(t, a["wasm.input.size"].AsInt64(), int64(len("log_ok_")))
+	test.Equals(t, a["wasm.errno"].AsInt64(), int64(0))
+	test.Len(t, spans[0].Events, 7)
+	test.Equals(t, spans[0].Events[0].Name, "log")
+	a = attrs(spans[1])
+	test.Equals(t, a["wasm.errno"].AsInt64(), int64(500))
+	test.Equals(t, a["wasm.output.size"].AsInt64(), int64(len("test_error")))
+	test.Equals(t, spans[1].Status.Code, codes.Error)
+
+	var rm metricdata.ResourceMetrics
+	err = reader.Collect(ctx, &rm)
+	test.Nil(t, err)
+	points := make(map[string]int)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch d := m.Data.(type) {
+			case metricdata.Histogram[float64]:
+				for _, p := range d.DataPoints {
+					points[m.Name] += int(p.Count)
+				}
+			case metricdata.Histogram[int64]:
+				for _, p := range d.DataPoints {
+					points[m.Name] += int(p.Count)
+				}
+			case metricdata.Sum[int64]:
+				for _, p := range d.DataPoints {
+					points[m.Name] += int(p.Value)
+				}
+			}
+		}
+	}
+	test.Equals(t, points["wasm.invocation.duration"], 2)
+	test.Equals(t, points["wasm.invocation.errors"], 1)
+	test.Equals(t, points["wasm.memory.pages"], 2)
+	test.Equals(t, points["wasm.compile.duration"], 2)
+}
+
+func TestTelemetryDisabled(t *testing.T) {
+	ctx := context.Background()
+	runtime := wasm.NewInterpreterRuntime()
+	defer runtime.Close(ctx)
+	m, err := wasm.NewModule(ctx, runtime, echo, "event", log)
+	test.Nil(t, err)
+	defer m.Close(ctx)
+	code, res, err := m.Run(ctx, "test")
+	test.Nil(t, err)
+	test.Equals(t, code, uint64(0))
+	test.Equals(t, res, "test")
+}
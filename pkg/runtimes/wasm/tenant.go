@@ -0,0 +1,344 @@
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/andrescosta/goico/pkg/service/obs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var (
+	ErrQuotaExceeded = errors.New("tenant quota exceeded")
+	ErrInvalidTenant = errors.New("invalid tenant name")
+	ErrTenantsClosed = errors.New("tenants are closed")
+)
+
+// Resources limited by a Quota.
+const (
+	QuotaInstances   = "instances"
+	QuotaMemory      = "memory"
+	QuotaInvocations = "invocations"
+	QuotaCache       = "cache"
+)
+
+// Quota limits the resources of a tenant. Zero values disable the limit.
+type Quota struct {
+	// MaxInstances is the maximum number of instances alive across the pools
+	// of the tenant.
+	MaxInstances int
+	// MaxMemoryPages is the maximum memory, in pages of 64 KiB, of the
+	// instances of the tenant together, counted from their creation. It also
+	// limits every instance. An instance that crosses it in an invocation is
+	// recycled after returning its result.
+	MaxMemoryPages uint32
+	// MaxInvocationsPerSecond is the sustained rate of invocations. Bursts of
+	// up to the same number of invocations are allowed.
+	MaxInvocationsPerSecond float64
+	// MaxCacheSize is the maximum size in bytes of the compilation cache.
+	MaxCacheSize int64
+}
+
+// QuotaError is returned when a tenant exceeds a quota.
+type QuotaError struct {
+	Tenant   string
+	Resource string
+	Limit    int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s: tenant %s exceeded the %s quota of %d", ErrQuotaExceeded, e.Tenant, e.Resource, e.Limit)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+type TenantsOption func(*Tenants)
+
+// Tenants isolates tenants from each other. Every tenant gets its own runtime,
+// compilation cache and quotas.
+type Tenants struct {
+	cacheDir     string
+	defaultQuota Quota
+	quotas       map[string]Quota
+	runtimeOpts  []RuntimeOption
+	otelProvider *obs.OtelProvider
+	mu           sync.Mutex
+	tenants      map[string]*Tenant
+	closed       bool
+}
+
+// Tenant runs the modules of a tenant within its quota.
+type Tenant struct {
+	name         string
+	quota        Quota
+	runtime      *Runtime
+	otelProvider *obs.OtelProvider
+	telemetry    *tenantTelemetry
+	attrs        metric.MeasurementOption
+	mu           sync.Mutex
+	instances    int
+	pages        map[*Module]uint32
+	memory       uint32
+	tokens       float64
+	last         time.Time
+}
+
+// TenantUsage is the usage of the resources of a tenant.
+type TenantUsage struct {
+	Instances   int
+	MemoryPages uint32
+}
+
+type tenantTelemetry struct {
+	instances metric.Int64UpDownCounter
+	memory    metric.Int64UpDownCounter
+	exceeded  metric.Int64Counter
+}
+
+// NewTenants returns the tenants. When cacheDir is not empty, the compilation
+// cache of every tenant is created in a subdirectory named after it.
+func NewTenants(cacheDir string, opts ...TenantsOption) *Tenants {
+	t := &Tenants{
+		cacheDir: cacheDir,
+		quotas:   make(map[string]Quota),
+		tenants:  make(map[string]*Tenant),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// Tenant returns the tenant, creating its runtime on first use.
+func (t *Tenants) Tenant(name string) (*Tenant, error) {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidTenant, name)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, ErrTenantsClosed
+	}
+	if tenant, ok := t.tenants[name]; ok {
+		return tenant, nil
+	}
+	quota, ok := t.quotas[name]
+	if !ok {
+		quota = t.defaultQuota
+	}
+	opts := append([]RuntimeOption{}, t.runtimeOpts...)
+	opts = append(opts, WithMaxCacheSize(quota.MaxCacheSize), WithMemoryLimitPages(quota.MaxMemoryPages))
+	var runtime *Runtime
+	if t.cacheDir != "" {
+		var err error
+		runtime, err = NewRuntimeWithCompilationCache(filepath.Join(t.cacheDir, name), opts...)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		runtime = NewRuntime(opts...)
+	}
+	telemetry, err := newTenantTelemetry(t.otelProvider)
+	if err != nil {
+		return nil, err
+	}
+	tenant := &Tenant{
+		name:         name,
+		quota:        quota,
+		runtime:      runtime,
+		otelProvider: t.otelProvider,
+		telemetry:    telemetry,
+		attrs:        metric.WithAttributes(attribute.String("wasm.tenant", name)),
+		pages:        make(map[*Module]uint32),
+		tokens:       burst(quota.MaxInvocationsPerSecond),
+		last:         time.Now(),
+	}
+	t.tenants[name] = tenant
+	return tenant, nil
+}
+
+// Close closes the runtimes of the tenants. The pools of the tenants must be
+// closed first.
+func (t *Tenants) Close(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrTenantsClosed
+	}
+	t.closed = true
+	var errs error
+	for _, tenant := range t.tenants {
+		errs = errors.Join(errs, tenant.runtime.Close(ctx))
+	}
+	return errs
+}
+
+func newTenantTelemetry(provider *obs.OtelProvider) (*tenantTelemetry, error) {
+	meter := provider.Meter(instrumentationName)
+	t := &tenantTelemetry{}
+	var err, errs error
+	t.instances, err = meter.Int64UpDownCounter("wasm.tenant.instances",
+		metric.WithDescription("Instances alive of the tenant."),
+		metric.WithUnit("{instance}"))
+	errs = errors.Join(errs, err)
+	t.memory, err = meter.Int64UpDownCounter("wasm.tenant.memory.pages",
+		metric.WithDescription("Memory pages of the instances of the tenant."),
+		metric.WithUnit("{page}"))
+	errs = errors.Join(errs, err)
+	t.exceeded, err = meter.Int64Counter("wasm.tenant.quota.exceeded",
+		metric.WithDescription("Operations rejected because the tenant exceeded a quota."))
+	errs = errors.Join(errs, err)
+	if errs != nil {
+		return nil, errs
+	}
+	return t, nil
+}
+
+func (t *Tenant) Name() string {
+	return t.name
+}
+
+func (t *Tenant) Quota() Quota {
+	return t.quota
+}
+
+// Runtime returns the runtime of the tenant.
+func (t *Tenant) Runtime() *Runtime {
+	return t.runtime
+}
+
+func (t *Tenant) Usage() TenantUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return TenantUsage{
+		Instances:   t.instances,
+		MemoryPages: t.memory,
+	}
+}
+
+// NewPool creates a pool, like NewPool, whose instances count toward the
+// quotas of the tenant.
+func (t *Tenant) NewPool(ctx context.Context, wasmModule []byte, mainFuncName string, logExt LogFn, size int, opts ...ModuleOption) (*Pool, error) {
+	opts = append([]ModuleOption{WithTenant(t.name), WithOtelProvider(t.otelProvider)}, opts...)
+	p, err := newPool(ctx, t, t.runtime, wasmModule, mainFuncName, logExt, size, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if t.quota.MaxCacheSize > 0 {
+		size, err := t.runtime.CacheSize()
+		if err == nil && size > t.quota.MaxCacheSize {
+			err = t.exceeded(ctx, QuotaCache, t.quota.MaxCacheSize)
+		}
+		if err != nil {
+			return nil, errors.Join(err, p.Close(ctx))
+		}
+	}
+	return p, nil
+}
+
+// acquire reserves an instance.
+func (t *Tenant) acquire(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.quota.MaxInstances > 0 && t.instances >= t.quota.MaxInstances {
+		return t.exceeded(ctx, QuotaInstances, int64(t.quota.MaxInstances))
+	}
+	t.instances++
+	t.telemetry.instances.Add(ctx, 1, t.attrs)
+	return nil
+}
+
+// release frees the instance and its memory. m is nil when the instance
+// could not be created.
+func (t *Tenant) release(ctx context.Context, m *Module) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.instances--
+	t.telemetry.instances.Add(ctx, -1, t.attrs)
+	if pages, ok := t.pages[m]; ok {
+		delete(t.pages, m)
+		t.memory -= pages
+		t.telemetry.memory.Add(ctx, -int64(pages), t.attrs)
+	}
+}
+
+// admit takes a token for an invocation.
+func (t *Tenant) admit(ctx context.Context) error {
+	rate := t.quota.MaxInvocationsPerSecond
+	if rate <= 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.tokens = math.Min(burst(rate), t.tokens+now.Sub(t.last).Seconds()*rate)
+	t.last = now
+	if t.tokens < 1 {
+		return t.exceeded(ctx, QuotaInvocations, int64(math.Ceil(rate)))
+	}
+	t.tokens--
+	return nil
+}
+
+// track updates the memory of the instance after an invocation. It returns a
+// QuotaError if the tenant exceeded its memory quota.
+func (t *Tenant) track(ctx context.Context, m *Module) error {
+	var pages uint32
+	if m.module != nil {
+		pages = m.module.Memory().Size() / pageSize
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delta := int64(pages) - int64(t.pages[m])
+	t.pages[m] = pages
+	t.memory = uint32(int64(t.memory) + delta)
+	if delta != 0 {
+		t.telemetry.memory.Add(ctx, delta, t.attrs)
+	}
+	if t.quota.MaxMemoryPages > 0 && t.memory > t.quota.MaxMemoryPages {
+		return t.exceeded(ctx, QuotaMemory, int64(t.quota.MaxMemoryPages))
+	}
+	return nil
+}
+
+func (t *Tenant) exceeded(ctx context.Context, resource string, limit int64) error {
+	t.telemetry.exceeded.Add(ctx, 1, t.attrs, metric.WithAttributes(attribute.String("wasm.quota.resource", resource)))
+	return &QuotaError{Tenant: t.name, Resource: resource, Limit: limit}
+}
+
+func burst(rate float64) float64 {
+	return math.Max(1, math.Ceil(rate))
+}
+
+// Setters
+func WithDefaultQuota(q Quota) TenantsOption {
+	return func(t *Tenants) {
+		t.defaultQuota = q
+	}
+}
+
+func WithQuota(tenant string, q Quota) TenantsOption {
+	return func(t *Tenants) {
+		t.quotas[tenant] = q
+	}
+}
+
+func WithTenantRuntimeOptions(opts ...RuntimeOption) TenantsOption {
+	return func(t *Tenants) {
+		t.runtimeOpts = opts
+	}
+}
+
+func WithTenantsOtelProvider(p *obs.OtelProvider) TenantsOption {
+	return func(t *Tenants) {
+		t.otelProvider = p
+	}
+}
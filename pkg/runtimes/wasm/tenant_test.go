@@ -0,0 +1,141 @@
+package wasm_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/andrescosta/goico/pkg/runtimes/wasm"
+	"github.com/andrescosta/goico/pkg/service/obs"
+	"github.com/andrescosta/goico/pkg/test"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestTenants(t *testing.T) {
+	ctx := context.Background()
+	reader := metric.NewManualReader()
+	provider := obs.NewWithProviders(sdktrace.NewTracerProvider(), metric.NewMeterProvider(metric.WithReader(reader)))
+	tenants := wasm.NewTenants("",
+		wasm.WithTenantRuntimeOptions(wasm.WithInterpreter()),
+		wasm.WithTenantsOtelProvider(provider),
+		wasm.WithDefaultQuota(wasm.Quota{MaxInstances: 1}),
+		wasm.WithQuota("memory", wasm.Quota{MaxMemoryPages: 5}),
+		wasm.WithQuota("rate", wasm.Quota{MaxInvocationsPerSecond: 2}))
+	defer func() {
+		test.Nil(t, tenants.Close(ctx))
+	}()
+	quotaError := func(t *testing.T, err error, resource string) {
+		t.Helper()
+		test.ErrorIs(t, err, wasm.ErrQuotaExceeded)
+		var qe *wasm.QuotaError
+		if !errors.As(err, &qe) {
+			t.Fatalf("expected QuotaError got %v", err)
+		}
+		test.Equals(t, qe.Resource, resource)
+	}
+
+	t.Run("instances", func(t *testing.T) {
+		tenant, err := tenants.Tenant("instances")
+		test.Nil(t, err)
+		p, err := tenant.NewPool(ctx, echo, "event", log, 2)
+		test.Nil(t, err)
+		_, err = tenant.NewPool(ctx, echo, "event", log, 1)
+		quotaError(t, err, wasm.QuotaInstances)
+		m, err := p.Get(ctx)
+		test.Nil(t, err)
+		_, err = p.Get(ctx)
+		quotaError(t, err, wasm.QuotaInstances)
+		p.Put(ctx, m)
+		test.Equals(t, tenant.Usage().Instances, 1)
+		test.Nil(t, p.Close(ctx))
+		test.Equals(t, tenant.Usage().Instances, 0)
+
+		// other tenants are not affected
+		other, err := tenants.Tenant("other")
+		test.Nil(t, err)
+		p, err = other.NewPool(ctx, echo, "event", log, 1)
+		test.Nil(t, err)
+		_, res, err := p.Run(ctx, "other")
+		test.Nil(t, err)
+		test.Equals(t, res, "other")
+		test.Nil(t, p.Close(ctx))
+	})
+	t.Run("memory", func(t *testing.T) {
+		tenant, err := tenants.Tenant("memory")
+		test.Nil(t, err)
+		// the instances start with 2 pages and leak one per invocation after
+		// the first
+		p1, err := tenant.NewPool(ctx, leak, "event", log, 1)
+		test.Nil(t, err)
+		defer p1.Close(ctx)
+		p2, err := tenant.NewPool(ctx, leak, "event", log, 1)
+		test.Nil(t, err)
+		defer p2.Close(ctx)
+		test.Equals(t, tenant.Usage().MemoryPages, uint32(4))
+		for i := 0; i < 2; i++ {
+			_, _, err := p1.Run(ctx, "in")
+			test.Nil(t, err)
+		}
+		_, _, err = p2.Run(ctx, "in")
+		test.Nil(t, err)
+		// the result of the invocation that exceeds the quota is returned
+		// and the instance is recycled
+		_, res, err := p2.Run(ctx, "over")
+		test.Nil(t, err)
+		test.Equals(t, res, "over")
+		test.Equals(t, tenant.Usage().Instances, 1)
+		test.Equals(t, tenant.Usage().MemoryPages, uint32(3))
+		_, res, err = p2.Run(ctx, "again")
+		test.Nil(t, err)
+		test.Equals(t, res, "again")
+		// the initial memory of a new instance counts toward the quota
+		_, err = tenant.NewPool(ctx, leak, "event", log, 1)
+		quotaError(t, err, wasm.QuotaMemory)
+		test.Equals(t, tenant.Usage().Instances, 2)
+	})
+	t.Run("rate", func(t *testing.T) {
+		tenant, err := tenants.Tenant("rate")
+		test.Nil(t, err)
+		p, err := tenant.NewPool(ctx, echo, "event", log, 1)
+		test.Nil(t, err)
+		defer p.Close(ctx)
+		for i := 0; i < 2; i++ {
+			_, _, err := p.Run(ctx, "in")
+			test.Nil(t, err)
+		}
+		_, _, err = p.Run(ctx, "in")
+		quotaError(t, err, wasm.QuotaInvocations)
+	})
+	t.Run("invalid_name", func(t *testing.T) {
+		_, err := tenants.Tenant("../x")
+		test.ErrorIs(t, err, wasm.ErrInvalidTenant)
+	})
+	t.Run("metrics", func(t *testing.T) {
+		var rm metricdata.ResourceMetrics
+		err := reader.Collect(ctx, &rm)
+		test.Nil(t, err)
+		exceeded := make(map[string]int64)
+		tenantRuns := make(map[string]bool)
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				switch m.Name {
+				case "wasm.tenant.quota.exceeded":
+					for _, p := range m.Data.(metricdata.Sum[int64]).DataPoints {
+						tenant, _ := p.Attributes.Value("wasm.tenant")
+						exceeded[tenant.AsString()] += p.Value
+					}
+				case "wasm.invocation.duration":
+					for _, p := range m.Data.(metricdata.Histogram[float64]).DataPoints {
+						tenant, _ := p.Attributes.Value(attribute.Key("wasm.tenant"))
+						tenantRuns[tenant.AsString()] = true
+					}
+				}
+			}
+		}
+		test.Equals(t, exceeded, map[string]int64{"instances": 2, "memory": 2, "rate": 1})
+		test.Equals(t, tenantRuns, map[string]bool{"other": true, "memory": true, "rate": true})
+	})
+}
@@ -1,15 +1,22 @@
 package wasm_test
 
 import (
+	"bytes"
 	"context"
 	_ "embed"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/andrescosta/goico/pkg/runtimes/wasm"
 	"github.com/andrescosta/goico/pkg/test"
+	"github.com/rs/zerolog"
 )
 
 //go:embed testdata/log.wasm
@@ -30,6 +37,18 @@ var sleeper []byte
 //go:embed testdata/greetrust.wasm
 var greetrust []byte
 
+//go:embed testdata/wasi.wasm
+var wasi []byte
+
+//go:embed testdata/command.wasm
+var command []byte
+
+//go:embed testdata/trap.wasm
+var trap []byte
+
+//go:embed testdata/stream.wasm
+var streamw []byte
+
 // Test sunny case: input-output
 // Test return error
 // Test log
@@ -228,6 +247,378 @@ func TestUsingGoroutines(t *testing.T) {
 	wg.Wait()
 }
 
+func TestModuleConfig(t *testing.T) {
+	ctx := context.Background()
+	runtime := wasm.NewInterpreterRuntime()
+	defer func() {
+		err := runtime.Close(ctx)
+		test.Nil(t, err)
+	}()
+	run := func(t *testing.T, mainFunc string, input string, opts ...wasm.ModuleOption) (uint64, string) {
+		t.Helper()
+		m, err := wasm.NewModule(ctx, runtime, wasi, mainFunc, log, opts...)
+		test.Nil(t, err)
+		t.Cleanup(func() {
+			m.Close(ctx)
+		})
+		code, res, err := m.Run(ctx, input)
+		test.Nil(t, err)
+		return code, res
+	}
+	t.Run("env", func(t *testing.T) {
+		_, res := run(t, "env", "", wasm.WithEnv("B", "2"), wasm.WithEnv("A", "1"))
+		if res != "A=1\x00B=2" {
+			t.Errorf("expected A=1,B=2 got %q", res)
+		}
+	})
+	t.Run("no_env", func(t *testing.T) {
+		_, res := run(t, "env", "")
+		if res != "" {
+			t.Errorf("expected empty env got %q", res)
+		}
+	})
+	t.Run("args", func(t *testing.T) {
+		_, res := run(t, "args", "", wasm.WithArgs("jobicolet", "-v"))
+		if res != "jobicolet\x00-v" {
+			t.Errorf("expected jobicolet -v got %q", res)
+		}
+	})
+	t.Run("stdout_stderr", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		_, res := run(t, "echo", "hello", wasm.WithStdout(&stdout), wasm.WithStderr(&stderr))
+		if res != "hello" {
+			t.Errorf("expected hello got %s", res)
+		}
+		if stdout.String() != "hello" {
+			t.Errorf("expected hello in stdout got %s", stdout.String())
+		}
+		if stderr.String() != "hello" {
+			t.Errorf("expected hello in stderr got %s", stderr.String())
+		}
+	})
+	t.Run("log_output", func(t *testing.T) {
+		var out bytes.Buffer
+		logger := zerolog.New(&out)
+		ctx := logger.WithContext(ctx)
+		m, err := wasm.NewModule(ctx, runtime, wasi, "echo", log, wasm.WithLogOutput())
+		test.Nil(t, err)
+		defer m.Close(ctx)
+		_, _, err = m.Run(ctx, "line\n")
+		test.Nil(t, err)
+		if !strings.Contains(out.String(), `"stream":"stdout"`) || !strings.Contains(out.String(), `"stream":"stderr"`) {
+			t.Errorf("expected stdout and stderr lines got %s", out.String())
+		}
+	})
+	t.Run("clock", func(t *testing.T) {
+		start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		_, res := run(t, "clock", "", wasm.WithClock(wasm.NewClock(start, time.Second)))
+		ns := int64(binary.LittleEndian.Uint64([]byte(res)))
+		if ns != start.UnixNano() {
+			t.Errorf("expected %d got %d", start.UnixNano(), ns)
+		}
+	})
+	t.Run("random", func(t *testing.T) {
+		seed := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+		_, res := run(t, "random", "", wasm.WithRandSource(bytes.NewReader(seed)))
+		if !bytes.Equal([]byte(res), seed) {
+			t.Errorf("expected %v got %v", seed, []byte(res))
+		}
+	})
+	t.Run("read_only_mount", func(t *testing.T) {
+		dir := t.TempDir()
+		err := os.WriteFile(filepath.Join(dir, "data.txt"), []byte("content"), 0o600)
+		test.Nil(t, err)
+		code, res := run(t, "readfile", "data.txt", wasm.WithReadOnlyDirMount(dir, "/"))
+		if code != 0 || res != "content" {
+			t.Errorf("expected 0 content got %d %s", code, res)
+		}
+		code, _ = run(t, "writefile", "data.txt", wasm.WithReadOnlyDirMount(dir, "/"))
+		if code == 0 {
+			t.Errorf("expected error writing to a read-only mount")
+		}
+	})
+	t.Run("mount", func(t *testing.T) {
+		dir := t.TempDir()
+		code, _ := run(t, "writefile", "out.txt", wasm.WithDirMount(dir, "/"))
+		if code != 0 {
+			t.Errorf("expected 0 got %d", code)
+		}
+		b, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+		test.Nil(t, err)
+		if string(b) != "written" {
+			t.Errorf("expected written got %s", string(b))
+		}
+	})
+}
+
+func TestCommandMode(t *testing.T) {
+	ctx := context.Background()
+	runtime := wasm.NewInterpreterRuntime()
+	defer func() {
+		err := runtime.Close(ctx)
+		test.Nil(t, err)
+	}()
+	var stdout bytes.Buffer
+	m, err := wasm.NewModule(ctx, runtime, command, "", log, wasm.WithMode(wasm.ModeCommand), wasm.WithStdout(&stdout))
+	test.Nil(t, err)
+	defer func() {
+		err := m.Close(ctx)
+		test.Nil(t, err)
+	}()
+	scenarios := []struct {
+		input string
+		code  uint64
+	}{
+		{"hello", 0},
+		{"!failed", 7},
+		{"", 0},
+		{"again", 0},
+	}
+	for _, s := range scenarios {
+		code, res, err := m.Run(ctx, s.input)
+		test.Nil(t, err)
+		if code != s.code {
+			t.Errorf("expected %d got %d", s.code, code)
+		}
+		if res != s.input {
+			t.Errorf("expected %s got %s", s.input, res)
+		}
+	}
+	if stdout.String() != "hello!failedagain" {
+		t.Errorf("expected all outputs in stdout got %s", stdout.String())
+	}
+}
+
+func TestInspect(t *testing.T) {
+	info, err := wasm.Inspect(echo)
+	test.Nil(t, err)
+	if info.ABI != wasm.TypeDefault {
+		t.Errorf("expected TypeDefault got %d", info.ABI)
+	}
+	if info.Mode != wasm.ModeReactor {
+		t.Errorf("expected ModeReactor got %d", info.Mode)
+	}
+	if info.Export("event") == nil {
+		t.Errorf("expected event export")
+	}
+	if info.Memory == nil || info.Memory.Min != 2 {
+		t.Errorf("expected memory with 2 pages got %v", info.Memory)
+	}
+	test.Nil(t, info.Validate(wasm.ModeReactor, "event"))
+
+	info, err = wasm.Inspect(greetrust)
+	test.Nil(t, err)
+	if info.ABI != wasm.TypeRust {
+		t.Errorf("expected TypeRust got %d", info.ABI)
+	}
+	hasDebugInfo := false
+	for _, c := range info.CustomSections {
+		if c.Name == ".debug_info" {
+			hasDebugInfo = true
+		}
+	}
+	if !hasDebugInfo {
+		t.Errorf("expected .debug_info section")
+	}
+
+	info, err = wasm.Inspect(command)
+	test.Nil(t, err)
+	if info.Mode != wasm.ModeCommand {
+		t.Errorf("expected ModeCommand got %d", info.Mode)
+	}
+	test.Len(t, info.Imports, 3)
+
+	_, err = wasm.Inspect([]byte("not a module"))
+	test.ErrorIs(t, err, wasm.ErrInvalidModule)
+}
+
+func TestValidation(t *testing.T) {
+	ctx := context.Background()
+	runtime := wasm.NewInterpreterRuntime()
+	defer func() {
+		err := runtime.Close(ctx)
+		test.Nil(t, err)
+	}()
+	_, err := wasm.NewModule(ctx, runtime, echo, "main", log)
+	test.ErrorIs(t, err, wasm.ErrInvalidModule)
+	if !strings.Contains(err.Error(), `missing export "main"`) {
+		t.Errorf("expected missing main got %s", err)
+	}
+	_, err = wasm.NewModule(ctx, runtime, echo, "malloc", log)
+	test.ErrorIs(t, err, wasm.ErrInvalidModule)
+	if !strings.Contains(err.Error(), `export "malloc" has signature (i32)->(i32)`) {
+		t.Errorf("expected wrong signature got %s", err)
+	}
+	_, err = wasm.NewModule(ctx, runtime, command, "event", log)
+	test.ErrorIs(t, err, wasm.ErrInvalidModule)
+	for _, e := range []string{"init", "malloc", "free", "event"} {
+		if !strings.Contains(err.Error(), fmt.Sprintf("missing export %q", e)) {
+			t.Errorf("expected missing %s got %s", e, err)
+		}
+	}
+	m, err := wasm.NewModule(ctx, runtime, echo, "", log, wasm.WithMode(wasm.ModeCommand))
+	test.Nil(t, err)
+	err = m.Close(ctx)
+	test.Nil(t, err)
+	_, err = wasm.NewModule(ctx, runtime, []byte{0, 1, 2}, "event", log)
+	test.ErrorIs(t, err, wasm.ErrInvalidModule)
+}
+
+func TestExecError(t *testing.T) {
+	ctx := context.Background()
+	runtime := wasm.NewInterpreterRuntime()
+	defer func() {
+		err := runtime.Close(ctx)
+		test.Nil(t, err)
+	}()
+	scenarios := []struct {
+		name     string
+		input    string
+		kind     wasm.ErrorKind
+		trap     wasm.Trap
+		exitCode uint32
+		frame    string
+	}{
+		{"unreachable", "u", wasm.KindTrap, wasm.TrapUnreachable, 0, ".do_unreachable()"},
+		{"out_of_bounds", "o", wasm.KindTrap, wasm.TrapOutOfBounds, 0, ".do_oob() i32"},
+		{"stack_overflow", "s", wasm.KindTrap, wasm.TrapStackOverflow, 0, ".recurse(i32) i32"},
+		{"divide_by_zero", "d", wasm.KindTrap, wasm.TrapDivideByZero, 0, ".divide(i32) i32"},
+		{"exit", "x", wasm.KindExit, "", 3, ""},
+	}
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			m, err := wasm.NewModule(ctx, runtime, trap, "event", log)
+			test.Nil(t, err)
+			defer m.Close(ctx)
+			_, _, err = m.Run(ctx, s.input)
+			var execErr *wasm.ExecError
+			if !errors.As(err, &execErr) {
+				t.Fatalf("expected ExecError got %v", err)
+			}
+			test.Equals(t, execErr.Kind, s.kind)
+			test.Equals(t, execErr.Trap, s.trap)
+			test.Equals(t, execErr.ExitCode, s.exitCode)
+			if s.frame == "" {
+				return
+			}
+			if len(execErr.Frames) < 3 {
+				t.Fatalf("expected stack trace got %v", execErr.Frames)
+			}
+			test.Equals(t, execErr.Frames[0].Function, s.frame)
+			if !execErr.Truncated {
+				test.Equals(t, execErr.Frames[len(execErr.Frames)-1].Function, ".event(i32,i32,i32)")
+			}
+		})
+	}
+	t.Run("panic", func(t *testing.T) {
+		m, err := wasm.NewModule(ctx, runtime, panicw, "event", log)
+		test.Nil(t, err)
+		defer m.Close(ctx)
+		_, _, err = m.Run(ctx, "panic")
+		var execErr *wasm.ExecError
+		if !errors.As(err, &execErr) {
+			t.Fatalf("expected ExecError got %v", err)
+		}
+		test.Equals(t, execErr.Kind, wasm.KindTrap)
+		test.Equals(t, execErr.Trap, wasm.TrapUnreachable)
+		test.NotEmpty(t, execErr.Frames)
+	})
+	t.Run("context", func(t *testing.T) {
+		m, err := wasm.NewModule(ctx, runtime, sleeper, "event", log)
+		test.Nil(t, err)
+		defer m.Close(ctx)
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		_, _, err = m.Run(ctx, "sleep")
+		var execErr *wasm.ExecError
+		if !errors.As(err, &execErr) {
+			t.Fatalf("expected ExecError got %v", err)
+		}
+		test.Equals(t, execErr.Kind, wasm.KindContext)
+	})
+	t.Run("dwarf", func(t *testing.T) {
+		execErr := wasm.NewExecError(errors.New("wasm error: unreachable\nwasm stack trace:\n" +
+			"\tgreet.panic()\n\t\t/src/lib.rs:10:5\n\t\t/src/inline.rs:3:1\n\tgreet.event(i32,i32,i32)\n"))
+		test.Equals(t, execErr.Kind, wasm.KindTrap)
+		test.Len(t, execErr.Frames, 2)
+		test.Equals(t, execErr.Frames[0].Sources, []string{"/src/lib.rs:10:5", "/src/inline.rs:3:1"})
+		test.Equals(t, execErr.Stack(), "greet.panic()\n\t/src/lib.rs:10:5\n\t/src/inline.rs:3:1\ngreet.event(i32,i32,i32)\n")
+	})
+}
+
+func TestRunStream(t *testing.T) {
+	ctx := context.Background()
+	runtime := wasm.NewInterpreterRuntime()
+	defer func() {
+		err := runtime.Close(ctx)
+		test.Nil(t, err)
+	}()
+	m, err := wasm.NewModule(ctx, runtime, streamw, "event", log, wasm.WithMaxEmitBytes(10))
+	test.Nil(t, err)
+	defer m.Close(ctx)
+
+	t.Run("channel", func(t *testing.T) {
+		ch := make(chan []byte)
+		var got []string
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for b := range ch {
+				// slow consumer, the guest waits for it
+				time.Sleep(5 * time.Millisecond)
+				got = append(got, string(b))
+			}
+		}()
+		code, res, err := m.RunStream(ctx, "a,bb,ccc", wasm.EmitTo(ch))
+		close(ch)
+		<-done
+		test.Nil(t, err)
+		test.Equals(t, code, uint64(0))
+		test.Equals(t, res, "a,bb,ccc")
+		test.Equals(t, got, []string{"a", "bb", "ccc"})
+	})
+	t.Run("limit", func(t *testing.T) {
+		var got []string
+		_, _, err := m.RunStream(ctx, "aaaa,bbbb,cccc", func(_ context.Context, b []byte) error {
+			got = append(got, string(b))
+			return nil
+		})
+		test.ErrorIs(t, err, wasm.ErrEmitLimit)
+		test.Equals(t, got, []string{"aaaa", "bbbb"})
+	})
+	t.Run("callback_error", func(t *testing.T) {
+		errStop := errors.New("stop")
+		m, err := wasm.NewModule(ctx, runtime, streamw, "event", log)
+		test.Nil(t, err)
+		defer m.Close(ctx)
+		_, _, err = m.RunStream(ctx, "a,b", func(context.Context, []byte) error {
+			return errStop
+		})
+		test.ErrorIs(t, err, errStop)
+	})
+	t.Run("canceled", func(t *testing.T) {
+		m, err := wasm.NewModule(ctx, runtime, streamw, "event", log)
+		test.Nil(t, err)
+		defer m.Close(ctx)
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		_, _, err = m.RunStream(ctx, "a,b", wasm.EmitTo(make(chan []byte)))
+		var execErr *wasm.ExecError
+		if !errors.As(err, &execErr) {
+			t.Fatalf("expected ExecError got %v", err)
+		}
+		test.Equals(t, execErr.Kind, wasm.KindContext)
+	})
+	t.Run("no_stream", func(t *testing.T) {
+		m, err := wasm.NewModule(ctx, runtime, streamw, "event", log)
+		test.Nil(t, err)
+		defer m.Close(ctx)
+		code, _, err := m.Run(ctx, "a,b")
+		test.Nil(t, err)
+		test.Equals(t, code, uint64(1))
+	})
+}
+
 func (s *scenariolog) log(_ context.Context, lvl uint32, message string) error {
 	if s.logsexpected == nil {
 		return errors.New("error")
@@ -0,0 +1,174 @@
+package bridge_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/andrescosta/goico/pkg/broadcaster"
+	"github.com/andrescosta/goico/pkg/service"
+	"github.com/andrescosta/goico/pkg/service/grpc/bridge"
+	"github.com/andrescosta/goico/pkg/service/grpc/cache/event"
+	"github.com/andrescosta/goico/pkg/test"
+)
+
+const addr = "bridge:1"
+
+func TestBridge(t *testing.T) {
+	t.Setenv("broadcaster_bridge.addr", addr)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := broadcaster.NewAndStart[*event.Event](ctx,
+		broadcaster.WithOrdered(10),
+		broadcaster.WithRetention(3, 0),
+		broadcaster.WithTopic(func(e *event.Event) string { return e.Name }))
+	defer func() {
+		_ = b.Stop()
+	}()
+	conn := start(ctx, t, func(s *bridge.Service) {
+		err := bridge.Register(s, "events", b, func(e *event.Event, params map[string]string) bool {
+			return params["type"] == "" || params["type"] == e.Type.String()
+		})
+		test.Nil(t, err)
+		err = bridge.Register(s, "events", b, nil)
+		test.ErrorIs(t, err, bridge.ErrDuplicated)
+	})
+
+	names := client(ctx, t, conn, bridge.WithTopics("a"), bridge.WithFromSeq(1))
+	deletes := client(ctx, t, conn, bridge.WithParams(map[string]string{"type": "Delete"}), bridge.WithFromSeq(1))
+	events := []*event.Event{
+		{Name: "a", Type: event.Event_Add},
+		{Name: "b", Type: event.Event_Delete},
+		{Name: "a", Type: event.Event_Delete},
+	}
+	for _, e := range events {
+		err := b.WriteCtx(ctx, e)
+		test.Nil(t, err)
+	}
+	e := receive(t, names)
+	test.Equals(t, e.Type, event.Event_Add)
+	e = receive(t, names)
+	test.Equals(t, e.Type, event.Event_Delete)
+	test.Equals(t, e.Name, "a")
+	e = receive(t, deletes)
+	test.Equals(t, e.Name, "b")
+	e = receive(t, deletes)
+	test.Equals(t, e.Name, "a")
+
+	t.Run("resume", func(t *testing.T) {
+		l := client(ctx, t, conn, bridge.WithFromSeq(2))
+		e := receive(t, l)
+		test.Equals(t, e.Name, "b")
+		e = receive(t, l)
+		test.Equals(t, e.Name, "a")
+	})
+
+	t.Run("heartbeat", func(t *testing.T) {
+		// raised to the minimum, so the client does not reconnect forever
+		c, err := bridge.NewClient[*event.Event](ctx, addr, conn, "events",
+			bridge.WithFromSeq(2),
+			bridge.WithHeartbeat(time.Microsecond))
+		test.Nil(t, err)
+		defer func() { _ = c.Close() }()
+		l, err := c.Subscribe(broadcaster.WithBufferSize(10))
+		test.Nil(t, err)
+		e := receive(t, l)
+		test.Equals(t, e.Name, "b")
+	})
+
+	t.Run("evicted", func(t *testing.T) {
+		err := b.WriteCtx(ctx, &event.Event{Name: "c"})
+		test.Nil(t, err)
+		l := client(ctx, t, conn, bridge.WithFromSeq(1))
+		// the client resumes with the next message, written once it is
+		// subscribed again
+		for {
+			err := b.WriteCtx(ctx, &event.Event{Name: "d"})
+			test.Nil(t, err)
+			select {
+			case e := <-l.C:
+				test.Equals(t, e.Name, "d")
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	})
+}
+
+func TestBridgeSlowListener(t *testing.T) {
+	t.Setenv("broadcaster_bridge.addr", addr)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := broadcaster.NewAndStart[*event.Event](ctx,
+		broadcaster.WithOrdered(10),
+		broadcaster.WithRetention(10, 0))
+	defer func() {
+		_ = b.Stop()
+	}()
+	conn := start(ctx, t, func(s *bridge.Service) {
+		err := bridge.Register(s, "events", b, nil)
+		test.Nil(t, err)
+	})
+	c, err := bridge.NewClient[*event.Event](ctx, addr, conn, "events",
+		bridge.WithFromSeq(1),
+		bridge.WithQueueSize(1),
+		bridge.WithHeartbeat(50*time.Millisecond),
+		bridge.WithBackoff(10*time.Millisecond, 100*time.Millisecond))
+	test.Nil(t, err)
+	defer func() { _ = c.Close() }()
+	l, err := c.Subscribe(broadcaster.WithPolicy(broadcaster.PolicyBlock))
+	test.Nil(t, err)
+	names := []string{"a", "b", "c", "d", "e", "f"}
+	for _, n := range names {
+		err := b.WriteCtx(ctx, &event.Event{Name: n})
+		test.Nil(t, err)
+	}
+	// the queue fills up, so the stream misses its heartbeats and is resumed
+	// from the last message queued
+	time.Sleep(500 * time.Millisecond)
+	for _, n := range names {
+		e := receive(t, l)
+		test.Equals(t, e.Name, n)
+	}
+	test.Equals(t, c.LastSeq(), uint64(len(names)))
+}
+
+func start(ctx context.Context, t *testing.T, register func(*bridge.Service)) *service.BufConn {
+	t.Helper()
+	conn := service.NewBufConnWithTimeout(5 * time.Second)
+	t.Cleanup(conn.CloseAll)
+	svc, err := bridge.NewService(ctx,
+		bridge.WithGrpcConn(service.GrpcConn{Dialer: conn, Listener: conn}))
+	test.Nil(t, err)
+	register(svc)
+	errch := make(chan error, 1)
+	go func() {
+		errch <- svc.Serve()
+	}()
+	t.Cleanup(func() { test.Nil(t, <-errch) })
+	return conn
+}
+
+func client(ctx context.Context, t *testing.T, conn *service.BufConn, opts ...bridge.ClientOption) *broadcaster.Listener[*event.Event] {
+	t.Helper()
+	opts = append(opts,
+		bridge.WithHeartbeat(50*time.Millisecond),
+		bridge.WithBackoff(10*time.Millisecond, 100*time.Millisecond))
+	c, err := bridge.NewClient[*event.Event](ctx, addr, conn, "events", opts...)
+	test.Nil(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+	l, err := c.Subscribe(broadcaster.WithBufferSize(10))
+	test.Nil(t, err)
+	return l
+}
+
+func receive(t *testing.T, l *broadcaster.Listener[*event.Event]) *event.Event {
+	t.Helper()
+	select {
+	case e := <-l.C:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+		return nil
+	}
+}
@@ -0,0 +1,230 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrescosta/goico/pkg/broadcaster"
+	"github.com/andrescosta/goico/pkg/service"
+	"github.com/andrescosta/goico/pkg/service/grpc/bridge/envelope"
+	"github.com/rs/zerolog"
+	rpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultQueueSize = 1024
+
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 10 * time.Second
+)
+
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	topics     []string
+	params     map[string]string
+	from       uint64
+	heartbeat  time.Duration
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	queueSize  int
+}
+
+// Client receives a stream of the bridge and broadcasts its messages to the
+// local listeners. It reconnects when the stream fails, resuming from the
+// last message queued for the listeners. A message waits for room in the
+// queue, so when the listeners do not keep up the stream misses its
+// heartbeats and is resumed later instead of dropping messages.
+type Client[T proto.Message] struct {
+	conn    *rpc.ClientConn
+	client  envelope.BridgeClient
+	stream  string
+	opts    clientOptions
+	bc      *broadcaster.Broadcaster[T]
+	lastSeq atomic.Uint64
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// NewClient connects to the stream of the bridge served at addr.
+func NewClient[T proto.Message](ctx context.Context, addr string, d service.GrpcDialer, stream string, opts ...ClientOption) (*Client[T], error) {
+	o := clientOptions{
+		heartbeat:  defaultHeartbeat,
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+		queueSize:  defaultQueueSize,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.heartbeat = max(o.heartbeat, minHeartbeat)
+	conn, err := d.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c := &Client[T]{
+		conn:   conn,
+		client: envelope.NewBridgeClient(conn),
+		stream: stream,
+		opts:   o,
+		bc:     broadcaster.NewAndStart[T](ctx, broadcaster.WithOrdered(o.queueSize)),
+		cancel: cancel,
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.run(ctx)
+	}()
+	return c, nil
+}
+
+// Subscribe returns a listener of the messages of the stream.
+func (c *Client[T]) Subscribe(opts ...broadcaster.SubscribeOption) (*broadcaster.Listener[T], error) {
+	return c.bc.Subscribe(opts...)
+}
+
+// LastSeq returns the sequence number of the last message queued for the
+// listeners, to resume the stream with WithFromSeq.
+func (c *Client[T]) LastSeq() uint64 {
+	return c.lastSeq.Load()
+}
+
+func (c *Client[T]) Close() error {
+	c.cancel()
+	c.wg.Wait()
+	return errors.Join(c.bc.Stop(), c.conn.Close())
+}
+
+// run receives the stream, reconnecting with an exponential backoff.
+func (c *Client[T]) run(ctx context.Context) {
+	logger := zerolog.Ctx(ctx)
+	backoff := c.opts.minBackoff
+	for {
+		received, err := c.recv(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if status.Code(err) == codes.OutOfRange {
+			logger.Warn().Str("stream", c.stream).Uint64("seq", c.resumeSeq()).Msg("bridge: messages lost, resuming with the next one")
+			c.lastSeq.Store(0)
+			c.opts.from = 0
+		} else {
+			logger.Debug().AnErr("error", err).Str("stream", c.stream).Msg("bridge: reconnecting")
+		}
+		if received {
+			backoff = c.opts.minBackoff
+		}
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		backoff = min(2*backoff, c.opts.maxBackoff)
+	}
+}
+
+// recv receives the stream until it fails, or it misses three heartbeats. It
+// reports whether a message was received.
+func (c *Client[T]) recv(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s, err := c.client.Subscribe(ctx, &envelope.SubscribeRequest{
+		Stream:      c.stream,
+		Topics:      c.opts.topics,
+		Params:      c.opts.params,
+		FromSeq:     c.resumeSeq(),
+		HeartbeatMs: c.opts.heartbeat.Milliseconds(),
+	})
+	if err != nil {
+		return false, err
+	}
+	watchdog := time.AfterFunc(3*c.opts.heartbeat, cancel)
+	defer watchdog.Stop()
+	received := false
+	for {
+		e, err := s.Recv()
+		if err != nil {
+			return received, err
+		}
+		watchdog.Reset(3 * c.opts.heartbeat)
+		if e.Heartbeat {
+			continue
+		}
+		var t T
+		m := t.ProtoReflect().New().Interface()
+		if err := e.Payload.UnmarshalTo(m); err != nil {
+			return received, err
+		}
+		received = true
+		if err := c.bc.WriteWait(ctx, m.(T)); err != nil {
+			return received, err
+		}
+		c.lastSeq.Store(e.Seq)
+	}
+}
+
+// resumeSeq is the sequence number the stream is resumed from, the next
+// message when 0.
+func (c *Client[T]) resumeSeq() uint64 {
+	if seq := c.lastSeq.Load(); seq > 0 {
+		return seq + 1
+	}
+	return c.opts.from
+}
+
+// Setters
+
+// WithTopics receives only the messages of the topics.
+func WithTopics(topics ...string) ClientOption {
+	return func(o *clientOptions) {
+		o.topics = topics
+	}
+}
+
+// WithParams sets the params of the filter of the stream.
+func WithParams(params map[string]string) ClientOption {
+	return func(o *clientOptions) {
+		o.params = params
+	}
+}
+
+// WithFromSeq starts the stream from a sequence number, e.g. the next of the
+// LastSeq of a previous client.
+func WithFromSeq(seq uint64) ClientOption {
+	return func(o *clientOptions) {
+		o.from = seq
+	}
+}
+
+// WithHeartbeat sets how often the server sends a heartbeat. The client
+// reconnects when it misses three. It is at least 50 milliseconds.
+func WithHeartbeat(d time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.heartbeat = d
+	}
+}
+
+// WithQueueSize sets how many messages wait for the local listeners. It is
+// 1024 by default.
+func WithQueueSize(n int) ClientOption {
+	return func(o *clientOptions) {
+		o.queueSize = n
+	}
+}
+
+// WithBackoff sets the initial and the maximum wait between reconnections.
+func WithBackoff(initial, maximum time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.minBackoff = initial
+		o.maxBackoff = maximum
+	}
+}
@@ -0,0 +1,215 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/andrescosta/goico/pkg/broadcaster"
+	"github.com/andrescosta/goico/pkg/service"
+	"github.com/andrescosta/goico/pkg/service/grpc"
+	"github.com/andrescosta/goico/pkg/service/grpc/bridge/envelope"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const name = "broadcaster_bridge"
+
+const (
+	defaultBufferSize = 64
+	defaultHeartbeat  = 15 * time.Second
+	// minHeartbeat bounds the heartbeats a client requests, so they do not
+	// flood the stream.
+	minHeartbeat = 50 * time.Millisecond
+)
+
+var ErrDuplicated = errors.New("stream already registered")
+
+// Filter reports whether a message is sent to a subscriber, with the params
+// of its request.
+type Filter[T proto.Message] func(t T, params map[string]string) bool
+
+type server struct {
+	envelope.UnimplementedBridgeServer
+	streams    *streams
+	bufferSize int
+}
+
+type streams struct {
+	mu sync.RWMutex
+	m  map[string]stream
+}
+
+// stream is a registered broadcaster.
+type stream interface {
+	serve(in *envelope.SubscribeRequest, out envelope.Bridge_SubscribeServer, bufferSize int) error
+}
+
+type typedStream[T proto.Message] struct {
+	b      *broadcaster.Broadcaster[T]
+	filter Filter[T]
+}
+
+type (
+	Setter  func(*Service)
+	Service struct {
+		grpc.Container
+		streams    *streams
+		bufferSize int
+	}
+)
+
+// NewService returns the service that exposes broadcasters of protobuf
+// messages as gRPC streams. Register adds the broadcasters it serves.
+func NewService(ctx context.Context, ops ...Setter) (*Service, error) {
+	s := &Service{
+		Container: grpc.Container{
+			Name: name,
+			GrpcConn: service.GrpcConn{
+				Dialer:   service.DefaultGrpcDialer,
+				Listener: service.DefaultGrpcListener,
+			},
+		},
+		streams:    &streams{m: make(map[string]stream)},
+		bufferSize: defaultBufferSize,
+	}
+	for _, op := range ops {
+		op(s)
+	}
+	svc, err := grpc.New(
+		grpc.WithName(name),
+		grpc.WithListener(s.Listener),
+		grpc.WithAddr(s.AddrOrPanic()),
+		grpc.WithContext(ctx),
+		grpc.WithServiceDesc(&envelope.Bridge_ServiceDesc),
+		grpc.WithNewServiceFn(func(_ context.Context) (any, error) {
+			return &server{
+				streams:    s.streams,
+				bufferSize: s.bufferSize,
+			}, nil
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	s.Svc = svc
+	return s, nil
+}
+
+// Register serves b as the stream name. filter can be nil. The broadcaster
+// needs WithRetention for the clients to resume after a reconnection.
+func Register[T proto.Message](s *Service, name string, b *broadcaster.Broadcaster[T], filter Filter[T]) error {
+	s.streams.mu.Lock()
+	defer s.streams.mu.Unlock()
+	if _, ok := s.streams.m[name]; ok {
+		return ErrDuplicated
+	}
+	s.streams.m[name] = &typedStream[T]{b: b, filter: filter}
+	return nil
+}
+
+func (s *Service) Serve() (err error) {
+	defer s.Svc.Dispose()
+	return s.Svc.Serve()
+}
+
+func (s *Service) Dispose() {
+	s.Svc.Dispose()
+}
+
+func (s *server) Subscribe(in *envelope.SubscribeRequest, out envelope.Bridge_SubscribeServer) error {
+	s.streams.mu.RLock()
+	st, ok := s.streams.m[in.Stream]
+	s.streams.mu.RUnlock()
+	if !ok {
+		return status.Errorf(codes.NotFound, "stream %q not found", in.Stream)
+	}
+	return st.serve(in, out, s.bufferSize)
+}
+
+// serve sends the messages of the broadcaster until the client goes away. A
+// subscriber that does not keep up is disconnected, so it resumes from its
+// last message instead of delaying the others.
+func (st *typedStream[T]) serve(in *envelope.SubscribeRequest, out envelope.Bridge_SubscribeServer, bufferSize int) error {
+	opts := []broadcaster.SubscribeOption{
+		broadcaster.WithBufferSize(bufferSize),
+		broadcaster.WithPolicy(broadcaster.PolicyDisconnect),
+	}
+	if len(in.Topics) > 0 {
+		opts = append(opts, broadcaster.WithTopics(in.Topics...))
+	}
+	if st.filter != nil {
+		params := in.Params
+		opts = append(opts, broadcaster.WithFilter(func(t T) bool {
+			return st.filter(t, params)
+		}))
+	}
+	l, err := st.b.SubscribeFrom(in.FromSeq, opts...)
+	if err != nil {
+		return toStatus(err)
+	}
+	defer func() {
+		_ = l.Close()
+	}()
+	heartbeat := defaultHeartbeat
+	if in.HeartbeatMs > 0 {
+		heartbeat = max(time.Duration(in.HeartbeatMs)*time.Millisecond, minHeartbeat)
+	}
+	t := time.NewTicker(heartbeat)
+	defer t.Stop()
+	for {
+		select {
+		case <-out.Context().Done():
+			return out.Context().Err()
+		case <-t.C:
+			if err := out.Send(&envelope.Envelope{Heartbeat: true}); err != nil {
+				return err
+			}
+		case m, ok := <-l.C:
+			if !ok {
+				if l.Stats().Disconnected {
+					return status.Error(codes.ResourceExhausted, "subscriber did not keep up")
+				}
+				return status.Error(codes.Unavailable, broadcaster.ErrStopped.Error())
+			}
+			payload, err := anypb.New(m.Value)
+			if err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+			if err := out.Send(&envelope.Envelope{Seq: m.Seq, Payload: payload}); err != nil {
+				return err
+			}
+			t.Reset(heartbeat)
+		}
+	}
+}
+
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, broadcaster.ErrEvicted):
+		return status.Error(codes.OutOfRange, err.Error())
+	case errors.Is(err, broadcaster.ErrNoTopic):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, broadcaster.ErrStopped):
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func WithGrpcConn(g service.GrpcConn) Setter {
+	return func(s *Service) {
+		s.Container.GrpcConn = g
+	}
+}
+
+// WithBufferSize sets how many messages are buffered for each subscriber
+// before it is disconnected.
+func WithBufferSize(n int) Setter {
+	return func(s *Service) {
+		s.bufferSize = n
+	}
+}
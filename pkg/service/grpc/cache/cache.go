@@ -7,23 +7,30 @@ import (
 
 	"github.com/andrescosta/goico/pkg/broadcaster"
 	"github.com/andrescosta/goico/pkg/service/grpc/cache/event"
+	"github.com/rs/zerolog"
 )
 
+// eventsQueueSize is the number of events waiting to be delivered to the
+// subscribers.
+const eventsQueueSize = 1024
+
 type Cache[K comparable, V any] struct {
 	name        string
 	defs        *sync.Map
 	broadcaster *broadcaster.Broadcaster[*event.Event]
+	logger      *zerolog.Logger
 }
 
 func New[K comparable, V any](ctx context.Context, name string, publish bool) *Cache[K, V] {
 	var b *broadcaster.Broadcaster[*event.Event]
 	if publish {
-		b = broadcaster.NewAndStart[*event.Event](ctx)
+		b = newEventsBroadcaster(ctx)
 	}
 	return &Cache[K, V]{
 		name:        name,
 		defs:        &sync.Map{},
 		broadcaster: b,
+		logger:      zerolog.Ctx(ctx),
 	}
 }
 
@@ -38,11 +45,13 @@ func (c *Cache[K, V]) Name() string {
 	return c.name
 }
 
-func (c *Cache[K, V]) Subscribe() (*broadcaster.Listener[*event.Event], error) {
+// Subscribe returns a listener of the changes of the cache. The topic of the
+// events is the name of the cache.
+func (c *Cache[K, V]) Subscribe(opts ...broadcaster.SubscribeOption) (*broadcaster.Listener[*event.Event], error) {
 	if c.broadcaster == nil {
 		return nil, errors.New("broadcasting disabled")
 	}
-	l, err := c.broadcaster.Subscribe()
+	l, err := c.broadcaster.Subscribe(opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -62,9 +71,7 @@ func (c *Cache[K, V]) AddOrUpdate(k K, v V) error {
 		Type: event.Event_Add,
 		Name: c.name,
 	}
-	if c.broadcaster != nil {
-		return c.broadcaster.Write(&e)
-	}
+	c.publish(&e)
 	return nil
 }
 
@@ -74,9 +81,7 @@ func (c *Cache[K, V]) Delete(k K) error {
 		Type: event.Event_Delete,
 		Name: c.name,
 	}
-	if c.broadcaster != nil {
-		return c.broadcaster.Write(&e)
-	}
+	c.publish(&e)
 	return nil
 }
 
@@ -86,12 +91,30 @@ func (c *Cache[K, V]) Update(k K, v V) error {
 		Type: event.Event_Update,
 		Name: c.name,
 	}
-	if c.broadcaster != nil {
-		return c.broadcaster.Write(&e)
-	}
+	c.publish(&e)
 	return nil
 }
 
+// publish queues the event of a change. The change is already stored, so an
+// event that is not queued is logged instead of failing the change.
+func (c *Cache[K, V]) publish(e *event.Event) {
+	if c.broadcaster == nil {
+		return
+	}
+	if err := c.broadcaster.WriteCtx(context.Background(), e); err != nil {
+		c.logger.Warn().Err(err).Str("cache", c.name).Str("type", e.Type.String()).Msg("cache: event not published")
+	}
+}
+
+// newEventsBroadcaster returns a broadcaster of events ordered, so
+// subscribers see the changes of a key in order, with the name of the cache
+// as topic.
+func newEventsBroadcaster(ctx context.Context) *broadcaster.Broadcaster[*event.Event] {
+	return broadcaster.NewAndStart[*event.Event](ctx,
+		broadcaster.WithOrdered(eventsQueueSize),
+		broadcaster.WithTopic(func(e *event.Event) string { return e.Name }))
+}
+
 func (c *Cache[K, V]) Get(k K) (V, bool) {
 	v, ok := c.defs.Load(k)
 	if !ok {
@@ -120,17 +120,19 @@ func (c *Client) Close() error {
 	return errors.Join(c.conn.Close(), err)
 }
 
-func (c *Client) ListenerForEvents(ctx context.Context) (*broadcaster.Listener[*event.Event], error) {
+// ListenerForEvents returns a listener of the events of the server. Use
+// broadcaster.WithTopics with the names of the caches to receive only theirs.
+func (c *Client) ListenerForEvents(ctx context.Context, opts ...broadcaster.SubscribeOption) (*broadcaster.Listener[*event.Event], error) {
 	if c.broadcasterEvent == nil {
 		if err := c.startListenerForEvents(ctx); err != nil {
 			return nil, err
 		}
 	}
-	return c.broadcasterEvent.Subscribe()
+	return c.broadcasterEvent.Subscribe(opts...)
 }
 
 func (c *Client) startListenerForEvents(ctx context.Context) error {
-	cb := broadcaster.NewAndStart[*event.Event](ctx)
+	cb := newEventsBroadcaster(ctx)
 	c.broadcasterEvent = cb
 	s, err := c.client.Events(ctx, &event.Empty{})
 	if err != nil {
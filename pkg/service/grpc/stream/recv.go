@@ -37,7 +37,9 @@ func Recv[T proto.Message](ctx context.Context, s grpc.ClientStream, bc *broadca
 				}
 				continue
 			}
-			if err := bc.Write(p.Interface().(T)); err != nil {
+			// waits for the listeners, so the stream is not read faster than
+			// they receive
+			if err := bc.WriteWait(ctx, p.Interface().(T)); err != nil {
 				return err
 			}
 		}
@@ -0,0 +1,156 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/andrescosta/goico/pkg/runtimes/wasm"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+const defaultWasmMaxBodySize = 1 << 20
+
+// WasmRunner executes a wasm module. Handlers call it concurrently, so it must
+// be safe for concurrent use, like wasm.Pool. The calls to a wasm.Module,
+// which is not, are serialized.
+type WasmRunner interface {
+	Run(ctx context.Context, data string) (uint64, string, error)
+}
+
+// serialRunner runs a module one request at a time.
+type serialRunner struct {
+	mu sync.Mutex
+	m  *wasm.Module
+}
+
+// WasmRoute mounts a module behind Path. The request is passed to the guest
+// as a WasmRequest JSON document and the guest is expected to return a
+// WasmResponse JSON document.
+type WasmRoute struct {
+	Path    string
+	Methods []string
+	Runner  WasmRunner
+	// MaxBodySize is the maximum size of the request body. Defaults to 1 MiB.
+	MaxBodySize int64
+}
+
+type WasmRequest struct {
+	Method  string              `json:"method"`
+	Path    string              `json:"path"`
+	Query   map[string][]string `json:"query,omitempty"`
+	Vars    map[string]string   `json:"vars,omitempty"`
+	Headers map[string][]string `json:"headers,omitempty"`
+	Body    []byte              `json:"body,omitempty"`
+}
+
+// WasmResponse is the result of the guest. A zero Status is 200 OK, or
+// 500 Internal Server Error when the guest returned a non-zero errno. The
+// bodies are base64 encoded in the JSON documents.
+type WasmResponse struct {
+	Status  int                 `json:"status,omitempty"`
+	Headers map[string][]string `json:"headers,omitempty"`
+	Body    []byte              `json:"body,omitempty"`
+}
+
+// WasmRoutes returns an init routes function, to be used with
+// WithInitRoutesFn, that serves the modules.
+func WasmRoutes(routes ...WasmRoute) func(context.Context, *mux.Router) error {
+	return func(_ context.Context, r *mux.Router) error {
+		for _, route := range routes {
+			if route.Runner == nil {
+				return fmt.Errorf("wasm route %s: runner is nil", route.Path)
+			}
+			h := r.Handle(route.Path, WasmHandler(route))
+			if len(route.Methods) > 0 {
+				h.Methods(route.Methods...)
+			}
+		}
+		return nil
+	}
+}
+
+// WasmHandler returns a handler that serves the module of the route.
+func WasmHandler(route WasmRoute) http.Handler {
+	maxBodySize := route.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = defaultWasmMaxBodySize
+	}
+	runner := route.Runner
+	if m, ok := runner.(*wasm.Module); ok {
+		runner = &serialRunner{m: m}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := zerolog.Ctx(r.Context())
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		req, err := json.Marshal(WasmRequest{
+			Method:  r.Method,
+			Path:    r.URL.Path,
+			Query:   r.URL.Query(),
+			Vars:    mux.Vars(r),
+			Headers: r.Header,
+			Body:    body,
+		})
+		if err != nil {
+			logger.Err(err).Msg("WasmHandler: error encoding request")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		errno, res, err := runner.Run(r.Context(), string(req))
+		if err != nil {
+			if r.Context().Err() != nil {
+				http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+				return
+			}
+			logger.Err(err).Str("path", route.Path).Msg("WasmHandler: error executing module")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		var resp WasmResponse
+		if err := json.Unmarshal([]byte(res), &resp); err != nil {
+			logger.Warn().AnErr("err", err).Str("path", route.Path).Msg("WasmHandler: invalid module response")
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		status := resp.Status
+		if status == 0 {
+			status = http.StatusOK
+			if errno != 0 {
+				status = http.StatusInternalServerError
+			}
+		}
+		// 1xx are not final and WriteHeader panics with invalid codes
+		if status < 200 || status > 999 {
+			logger.Warn().Int("status", status).Str("path", route.Path).Msg("WasmHandler: invalid module status")
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		for k, vs := range resp.Headers {
+			for _, v := range vs {
+				w.Header().Add(k, v)
+			}
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write(resp.Body)
+	})
+}
+
+func (s *serialRunner) Run(ctx context.Context, data string) (uint64, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m.Run(ctx, data)
+}
@@ -0,0 +1,154 @@
+package http_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	stdhttptest "net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/andrescosta/goico/pkg/runtimes/wasm"
+	httpsvc "github.com/andrescosta/goico/pkg/service/http"
+	"github.com/andrescosta/goico/pkg/test"
+	"github.com/gorilla/mux"
+)
+
+var (
+	_ httpsvc.WasmRunner = (*wasm.Module)(nil)
+	_ httpsvc.WasmRunner = (*wasm.Pool)(nil)
+)
+
+// runner calls fn with the decoded request, like a guest would.
+type runner func(httpsvc.WasmRequest) (uint64, string, error)
+
+func (r runner) Run(_ context.Context, data string) (uint64, string, error) {
+	var req httpsvc.WasmRequest
+	if err := json.Unmarshal([]byte(data), &req); err != nil {
+		return 0, "", err
+	}
+	return r(req)
+}
+
+func TestWasmRoutes(t *testing.T) {
+	echo := runner(func(req httpsvc.WasmRequest) (uint64, string, error) {
+		res, err := json.Marshal(httpsvc.WasmResponse{
+			Status:  http.StatusCreated,
+			Headers: map[string][]string{"X-Method": {req.Method}, "X-Id": {req.Vars["id"]}, "X-Q": req.Query["q"]},
+			Body:    req.Body,
+		})
+		return 0, string(res), err
+	})
+	failed := runner(func(httpsvc.WasmRequest) (uint64, string, error) {
+		return 1, `{"body":"ZmFpbGVk"}`, nil
+	})
+	broken := runner(func(httpsvc.WasmRequest) (uint64, string, error) {
+		return 0, "not json", nil
+	})
+	invalid := runner(func(httpsvc.WasmRequest) (uint64, string, error) {
+		return 0, `{"status":42}`, nil
+	})
+	trap := runner(func(httpsvc.WasmRequest) (uint64, string, error) {
+		return 0, "", errors.New("trap")
+	})
+	router := mux.NewRouter()
+	err := httpsvc.WasmRoutes(
+		httpsvc.WasmRoute{Path: "/echo/{id}", Methods: []string{http.MethodPost}, Runner: echo, MaxBodySize: 10},
+		httpsvc.WasmRoute{Path: "/failed", Runner: failed},
+		httpsvc.WasmRoute{Path: "/broken", Runner: broken},
+		httpsvc.WasmRoute{Path: "/trap", Runner: trap},
+		httpsvc.WasmRoute{Path: "/invalid", Runner: invalid},
+	)(context.Background(), router)
+	test.Nil(t, err)
+
+	scenarios := []struct {
+		name    string
+		method  string
+		url     string
+		body    string
+		status  int
+		resBody string
+		headers map[string]string
+	}{
+		{"echo", http.MethodPost, "/echo/12?q=v", "hello", http.StatusCreated, "hello",
+			map[string]string{"X-Method": "POST", "X-Id": "12", "X-Q": "v"}},
+		{"method_not_allowed", http.MethodGet, "/echo/12", "", http.StatusMethodNotAllowed, "", nil},
+		{"too_large", http.MethodPost, "/echo/12", "hello world!", http.StatusRequestEntityTooLarge, "", nil},
+		{"errno", http.MethodGet, "/failed", "", http.StatusInternalServerError, "failed", nil},
+		{"invalid_response", http.MethodGet, "/broken", "", http.StatusBadGateway, "", nil},
+		{"error", http.MethodGet, "/trap", "", http.StatusInternalServerError, "", nil},
+		{"invalid_status", http.MethodGet, "/invalid", "", http.StatusBadGateway, "", nil},
+	}
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			rec := stdhttptest.NewRecorder()
+			router.ServeHTTP(rec, stdhttptest.NewRequest(s.method, s.url, strings.NewReader(s.body)))
+			res := rec.Result()
+			defer res.Body.Close()
+			test.Equals(t, res.StatusCode, s.status)
+			if s.resBody != "" {
+				b, err := io.ReadAll(res.Body)
+				test.Nil(t, err)
+				test.Equals(t, string(b), s.resBody)
+			}
+			for k, v := range s.headers {
+				test.Equals(t, res.Header.Get(k), v)
+			}
+		})
+	}
+
+	err = httpsvc.WasmRoutes(httpsvc.WasmRoute{Path: "/nil"})(context.Background(), mux.NewRouter())
+	test.NotNil(t, err)
+}
+
+func TestWasmGuest(t *testing.T) {
+	ctx := context.Background()
+	runtime := wasm.NewRuntime(wasm.WithInterpreter())
+	defer func() {
+		err := runtime.Close(ctx)
+		test.Nil(t, err)
+	}()
+	echo, err := os.ReadFile(filepath.Join("..", "..", "runtimes", "wasm", "testdata", "echo.wasm"))
+	test.Nil(t, err)
+	logFn := func(context.Context, uint32, string) error { return nil }
+	// echo returns the request, which is a response with its headers and body
+	m, err := wasm.NewModule(ctx, runtime, echo, "event", logFn)
+	test.Nil(t, err)
+	defer m.Close(ctx)
+	pool, err := wasm.NewPool(ctx, runtime, echo, "event", logFn, 2)
+	test.Nil(t, err)
+	defer pool.Close(ctx)
+	router := mux.NewRouter()
+	err = httpsvc.WasmRoutes(
+		httpsvc.WasmRoute{Path: "/module", Runner: m},
+		httpsvc.WasmRoute{Path: "/pool", Runner: pool},
+	)(ctx, router)
+	test.Nil(t, err)
+	body := []byte{0, 0xff, 'a', 0x80}
+	for _, path := range []string{"/module", "/pool"} {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rec := stdhttptest.NewRecorder()
+				req := stdhttptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+				req.Header.Set("X-Guest", "echo")
+				router.ServeHTTP(rec, req)
+				res := rec.Result()
+				defer res.Body.Close()
+				b, err := io.ReadAll(res.Body)
+				if err != nil || res.StatusCode != http.StatusOK || !bytes.Equal(b, body) || res.Header.Get("X-Guest") != "echo" {
+					t.Errorf("%s: unexpected response %d %v %q", path, res.StatusCode, err, b)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
@@ -23,11 +23,15 @@ import (
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
 	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
 	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	otelmetric "go.opentelemetry.io/otel/metric"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 )
@@ -223,6 +227,16 @@ func New(ctx context.Context, info meta.Data) (*OtelProvider, error) {
 	}, nil
 }
 
+// NewWithProviders returns an enabled provider that uses the given providers.
+// Any of them can be nil.
+func NewWithProviders(traceProvider *sdktrace.TracerProvider, meterProvider *metric.MeterProvider) *OtelProvider {
+	return &OtelProvider{
+		enabled:       true,
+		traceProvider: traceProvider,
+		meterProvider: meterProvider,
+	}
+}
+
 func (o *OtelProvider) Shutdown(ctx context.Context) error {
 	var errf error
 	if o.traceProvider != nil {
@@ -285,6 +299,22 @@ func newMeterProviderArr(res *resource.Resource, exps []metric.Exporter, interva
 	return meterProvider, nil
 }
 
+// Tracer returns a named tracer, or a no-op one when traces are not enabled.
+func (o *OtelProvider) Tracer(name string) trace.Tracer {
+	if o == nil || !o.enabled || o.traceProvider == nil {
+		return tracenoop.NewTracerProvider().Tracer(name)
+	}
+	return o.traceProvider.Tracer(name)
+}
+
+// Meter returns a named meter, or a no-op one when metrics are not enabled.
+func (o *OtelProvider) Meter(name string) otelmetric.Meter {
+	if o == nil || !o.enabled || o.meterProvider == nil {
+		return metricnoop.NewMeterProvider().Meter(name)
+	}
+	return o.meterProvider.Meter(name)
+}
+
 func (o *OtelProvider) InstrRouter(name string, r *mux.Router) {
 	if o.enabled {
 		r.Use(otelmux.Middleware(name))